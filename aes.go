@@ -3,10 +3,7 @@ package gocrypt
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
 	"encoding/hex"
-	"fmt"
-	"io"
 
 	"github.com/pkg/errors"
 )
@@ -47,46 +44,85 @@ func NewAESOpt(secret string) (*AESOpt, error) {
 
 // Encrypt is function to encrypt data using AES algorithm
 func (aesOpt *AESOpt) Encrypt(plainText []byte) (string, error) {
-	if aesOpt == nil || aesOpt.aesGCM == nil {
-		return "", errors.New("AESOpt is not properly initialized")
-	}
+	return sealBytes(aesOpt, encodingHex, plainText)
+}
 
-	//Create a nonce. Nonce should be from GCM
-	nonce := make([]byte, aesOpt.aesGCM.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return "", errors.Wrap(err, "encryptAES.io.ReadFull")
+// EncryptRaw is function to encrypt data using AES algorithm without encoding
+// the result, the nonce is prefixed to the ciphertext
+func (aesOpt *AESOpt) EncryptRaw(plainText []byte) ([]byte, error) {
+	dst := make([]byte, aesOpt.sealedLen(len(plainText)))
+	copy(dst[gcmNonceSize:], plainText)
+	if err := aesOpt.seal(dst, len(plainText)); err != nil {
+		return nil, err
 	}
-
-	//Encrypt the data using aesGCM.Seal
-	//Since we don't want to save the nonce somewhere else in this case, we add it as a prefix to the encrypted data. The first nonce argument in Seal is the prefix.
-	ciphertext := aesOpt.aesGCM.Seal(nonce, nonce, plainText, nil)
-	return fmt.Sprintf("%x", ciphertext), nil
+	return dst, nil
 }
 
 // Decrypt is function to decypt data using AES algorithm
 func (aesOpt *AESOpt) Decrypt(cipherText []byte) (string, error) {
 	if aesOpt == nil || aesOpt.aesGCM == nil {
-		return "", errors.New("AESOpt is not properly initialized")
+		return "", newError(ErrNotInitialized, "AESOpt is not properly initialized")
 	}
+	return openBytes(aesOpt, encodingHex, cipherText)
+}
 
-	enc, err := hex.DecodeString(string(cipherText))
+// DecryptRaw is function to decrypt data produced by EncryptRaw using AES algorithm
+func (aesOpt *AESOpt) DecryptRaw(enc []byte) ([]byte, error) {
+	return aesOpt.open(append([]byte(nil), enc...))
+}
+
+// Sizes of the GCM mode cipher.NewGCM returns
+const (
+	gcmNonceSize = 12
+	gcmTagSize   = 16
+)
+
+func (aesOpt *AESOpt) prefixLen() int       { return gcmNonceSize }
+func (aesOpt *AESOpt) sealedLen(n int) int  { return gcmNonceSize + n + gcmTagSize }
+func (aesOpt *AESOpt) textEncoding() string { return encodingHex }
+
+func (aesOpt *AESOpt) seal(dst []byte, n int) error {
+	if aesOpt == nil || aesOpt.aesGCM == nil {
+		return newError(ErrNotInitialized, "AESOpt is not properly initialized")
+	}
+	return gcmSeal(aesOpt.aesGCM, dst, n)
+}
+
+func (aesOpt *AESOpt) open(enc []byte) ([]byte, error) {
+	if aesOpt == nil || aesOpt.aesGCM == nil {
+		return nil, newError(ErrNotInitialized, "AESOpt is not properly initialized")
+	}
+	plainText, err := gcmOpen(aesOpt.aesGCM, enc)
 	if err != nil {
-		return "", errors.Wrap(err, "Decrypt.hex.DecodeString")
+		return nil, errors.WithMessage(err, "decryptAES")
 	}
+	return plainText, nil
+}
 
-	//Get the nonce size
-	nonceSize := aesOpt.aesGCM.NonceSize()
-	if len(enc) < nonceSize {
-		return "", errors.New("The data can't be decrypted")
+// gcmSeal encrypts the n bytes of plain text following the nonce in place.
+// Since we don't want to save the nonce somewhere else, it is the prefix of
+// the encrypted data.
+func gcmSeal(aesGCM cipher.AEAD, dst []byte, n int) error {
+	nonce := dst[:gcmNonceSize]
+	if err := nonces.read(nonce); err != nil {
+		return err
+	}
+	plainText := dst[gcmNonceSize : gcmNonceSize+n]
+	aesGCM.Seal(plainText[:0], nonce, plainText, nil)
+	return nil
+}
+
+// gcmOpen decrypts data produced by gcmSeal in place
+func gcmOpen(aesGCM cipher.AEAD, enc []byte) ([]byte, error) {
+	if len(enc) < gcmNonceSize+gcmTagSize {
+		return nil, newError(ErrMalformedCiphertext, "The data can't be decrypted: ciphertext too short")
 	}
 	//Extract the nonce from the encrypted data
-	nonce, ciphertext := enc[:nonceSize], enc[nonceSize:]
+	nonce, ciphertext := enc[:gcmNonceSize], enc[gcmNonceSize:]
 
-	//Decrypt the data
-	plainText, err := aesOpt.aesGCM.Open(nil, nonce, ciphertext, nil)
+	plainText, err := aesGCM.Open(ciphertext[:0], nonce, ciphertext, nil)
 	if err != nil {
-		return "", errors.Wrap(err, "decryptAES.aesGCM.Open")
+		return nil, wrapError(ErrAuthenticationFailed, err, "aesGCM.Open")
 	}
-
-	return string(plainText), nil
+	return plainText, nil
 }
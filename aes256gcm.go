@@ -3,10 +3,7 @@ package gocrypt
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
 	"encoding/hex"
-	"fmt"
-	"io"
 
 	"github.com/pkg/errors"
 )
@@ -51,21 +48,18 @@ func NewAES256GCMOpt(secret string) (*AES256GCMOpt, error) {
 // Format: nonce (12 bytes) + ciphertext, all hex encoded
 // This format is compatible with JavaScript crypto.subtle API
 func (aesOpt *AES256GCMOpt) Encrypt(plainText []byte) (string, error) {
-	if aesOpt == nil || aesOpt.aesGCM == nil {
-		return "", errors.New("AES256GCMOpt is not properly initialized")
-	}
+	return sealBytes(aesOpt, encodingHex, plainText)
+}
 
-	// Create a nonce. Nonce should be from GCM (12 bytes for AES-GCM)
-	nonceSize := aesOpt.aesGCM.NonceSize()
-	nonce := make([]byte, nonceSize)
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return "", errors.Wrap(err, "Encrypt.io.ReadFull")
+// EncryptRaw is function to encrypt data using AES-256-GCM algorithm
+// Format: nonce (12 bytes) + ciphertext, not encoded
+func (aesOpt *AES256GCMOpt) EncryptRaw(plainText []byte) ([]byte, error) {
+	dst := make([]byte, aesOpt.sealedLen(len(plainText)))
+	copy(dst[gcmNonceSize:], plainText)
+	if err := aesOpt.seal(dst, len(plainText)); err != nil {
+		return nil, err
 	}
-
-	// Encrypt the data using aesGCM.Seal
-	// The nonce is prefixed to the encrypted data for compatibility with JavaScript
-	ciphertext := aesOpt.aesGCM.Seal(nonce, nonce, plainText, nil)
-	return fmt.Sprintf("%x", ciphertext), nil
+	return dst, nil
 }
 
 // Decrypt is function to decrypt data using AES-256-GCM algorithm
@@ -73,28 +67,35 @@ func (aesOpt *AES256GCMOpt) Encrypt(plainText []byte) (string, error) {
 // This format is compatible with JavaScript crypto.subtle API
 func (aesOpt *AES256GCMOpt) Decrypt(cipherText []byte) (string, error) {
 	if aesOpt == nil || aesOpt.aesGCM == nil {
-		return "", errors.New("AES256GCMOpt is not properly initialized")
+		return "", newError(ErrNotInitialized, "AES256GCMOpt is not properly initialized")
 	}
+	return openBytes(aesOpt, encodingHex, cipherText)
+}
 
-	enc, err := hex.DecodeString(string(cipherText))
-	if err != nil {
-		return "", errors.Wrap(err, "Decrypt.hex.DecodeString")
-	}
+// DecryptRaw is function to decrypt data using AES-256-GCM algorithm
+// Format: nonce (12 bytes) + ciphertext, not encoded
+func (aesOpt *AES256GCMOpt) DecryptRaw(enc []byte) ([]byte, error) {
+	return aesOpt.open(append([]byte(nil), enc...))
+}
 
-	// Get the nonce size (12 bytes for AES-GCM)
-	nonceSize := aesOpt.aesGCM.NonceSize()
-	if len(enc) < nonceSize {
-		return "", errors.New("The data can't be decrypted: ciphertext too short")
-	}
+func (aesOpt *AES256GCMOpt) prefixLen() int       { return gcmNonceSize }
+func (aesOpt *AES256GCMOpt) sealedLen(n int) int  { return gcmNonceSize + n + gcmTagSize }
+func (aesOpt *AES256GCMOpt) textEncoding() string { return encodingHex }
 
-	// Extract the nonce from the encrypted data
-	nonce, ciphertext := enc[:nonceSize], enc[nonceSize:]
+func (aesOpt *AES256GCMOpt) seal(dst []byte, n int) error {
+	if aesOpt == nil || aesOpt.aesGCM == nil {
+		return newError(ErrNotInitialized, "AES256GCMOpt is not properly initialized")
+	}
+	return gcmSeal(aesOpt.aesGCM, dst, n)
+}
 
-	// Decrypt the data
-	plainText, err := aesOpt.aesGCM.Open(nil, nonce, ciphertext, nil)
+func (aesOpt *AES256GCMOpt) open(enc []byte) ([]byte, error) {
+	if aesOpt == nil || aesOpt.aesGCM == nil {
+		return nil, newError(ErrNotInitialized, "AES256GCMOpt is not properly initialized")
+	}
+	plainText, err := gcmOpen(aesOpt.aesGCM, enc)
 	if err != nil {
-		return "", errors.Wrap(err, "Decrypt.aesGCM.Open")
+		return nil, errors.WithMessage(err, "Decrypt")
 	}
-
-	return string(plainText), nil
+	return plainText, nil
 }
@@ -0,0 +1,116 @@
+package gocrypt
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+// isBytesType reports whether typ is a byte slice such as []byte or
+// json.RawMessage, which gocrypt transforms as a whole like a string.
+func isBytesType(typ reflect.Type) bool {
+	return typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.Uint8
+}
+
+// isTextType reports whether typ can hold ciphertext: a string, []byte or
+// json.RawMessage.
+func isTextType(typ reflect.Type) bool {
+	return typ.Kind() == reflect.String || isBytesType(typ)
+}
+
+// isBlobType reports whether a value of typ, or of the type typ points to, is
+// a subtree gocrypt can encrypt as a single JSON document into a companion
+// field: a struct, map, slice or array.
+func isBlobType(typ reflect.Type) bool {
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	switch typ.Kind() {
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+		return true
+	default:
+		return false
+	}
+}
+
+// isEmptyText reports whether a string, []byte or json.RawMessage holds no
+// value. A json.RawMessage of null is empty.
+func isEmptyText(val reflect.Value) bool {
+	if val.Type() == rawMessageType && string(val.Bytes()) == "null" {
+		return true
+	}
+	return val.Len() == 0
+}
+
+// getText returns the text held by a string, []byte or json.RawMessage. A
+// json.RawMessage holding ciphertext is a JSON string.
+func getText(val reflect.Value, cipherText bool) (string, error) {
+	switch {
+	case val.Kind() == reflect.String:
+		return val.String(), nil
+	case val.Type() == rawMessageType && cipherText:
+		var text string
+		if err := json.Unmarshal(val.Bytes(), &text); err != nil {
+			return "", wrapError(ErrMalformedCiphertext, err, "json.RawMessage is not a JSON string")
+		}
+		return text, nil
+	default:
+		return string(val.Bytes()), nil
+	}
+}
+
+// jsonString returns the string held by a json.RawMessage, and whether it
+// holds one.
+func jsonString(val reflect.Value) (string, bool) {
+	var text string
+	if err := json.Unmarshal(val.Bytes(), &text); err != nil {
+		return "", false
+	}
+	return text, true
+}
+
+// textValue returns text as a value of typ, a string, []byte or
+// json.RawMessage type. Ciphertext in a json.RawMessage is stored as a JSON
+// string so the message stays valid JSON.
+func textValue(typ reflect.Type, text string, cipherText bool) reflect.Value {
+	switch {
+	case typ.Kind() == reflect.String:
+		return reflect.ValueOf(text).Convert(typ)
+	case typ == rawMessageType && cipherText:
+		quoted, _ := json.Marshal(text)
+		return reflect.ValueOf(quoted).Convert(typ)
+	default:
+		return reflect.ValueOf([]byte(text)).Convert(typ)
+	}
+}
+
+// intoText returns the text form of a non-nil into= field: the text of a
+// scalar, or the JSON document of a subtree.
+func intoText(val reflect.Value) (string, error) {
+	if isScalarType(val.Type()) {
+		if val.Kind() == reflect.Ptr {
+			val = val.Elem()
+		}
+		return formatScalar(val)
+	}
+	doc, err := json.Marshal(val.Interface())
+	return string(doc), err
+}
+
+// parseInto returns a value of typ parsed from text, the inverse of
+// intoText.
+func parseInto(typ reflect.Type, text string) (reflect.Value, error) {
+	decrypted := reflect.New(typ).Elem()
+	if !isScalarType(typ) {
+		err := json.Unmarshal([]byte(text), decrypted.Addr().Interface())
+		return decrypted, err
+	}
+
+	scalar := decrypted
+	if typ.Kind() == reflect.Ptr {
+		decrypted.Set(reflect.New(typ.Elem()))
+		scalar = decrypted.Elem()
+	}
+	return decrypted, parseScalar(scalar, text)
+}
@@ -0,0 +1,228 @@
+package gocrypt
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// sealer is implemented by the built-in options. They encrypt and decrypt in
+// place in a buffer of the caller, so that a field only allocates its
+// resulting string.
+type sealer interface {
+	// prefixLen is the length of the nonce or IV the ciphertext starts with
+	prefixLen() int
+	// sealedLen is the length of the ciphertext of n bytes of plain text
+	sealedLen(n int) int
+	// seal encrypts the n bytes of plain text at dst[prefixLen():], dst has
+	// the length sealedLen(n)
+	seal(dst []byte, n int) error
+	// open decrypts src in place and returns the plain text, a part of src
+	open(src []byte) ([]byte, error)
+	// textEncoding is the encoding of Encrypt and Decrypt
+	textEncoding() string
+}
+
+// sealerOf returns the sealer of a built-in option. Types embedding a built-in
+// option are left out on purpose, they may override Encrypt and Decrypt.
+func sealerOf(gocryptOpt GocryptOption) (sealer, bool) {
+	switch o := gocryptOpt.(type) {
+	case *AESOpt:
+		return o, true
+	case *AES256GCMOpt:
+		return o, true
+	case *DESOpt:
+		return o, true
+	case *RC4Opt:
+		return o, true
+	default:
+		return nil, false
+	}
+}
+
+// maxPooledBuffer keeps buffers of unusually large fields out of the pool
+const maxPooledBuffer = 64 << 10
+
+type buffer struct {
+	b []byte
+}
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return &buffer{b: make([]byte, 0, 512)}
+	},
+}
+
+// getBuffer returns a pooled buffer of length n
+func getBuffer(n int) *buffer {
+	buf := bufferPool.Get().(*buffer)
+	if cap(buf.b) < n {
+		buf.b = make([]byte, n)
+	}
+	buf.b = buf.b[:n]
+	return buf
+}
+
+// free clears the buffer, it held plain text, and returns it to the pool
+func (buf *buffer) free() {
+	for i := range buf.b {
+		buf.b[i] = 0
+	}
+	if cap(buf.b) > maxPooledBuffer {
+		return
+	}
+	buf.b = buf.b[:0]
+	bufferPool.Put(buf)
+}
+
+// nonceSource hands out random bytes for nonces and IVs. It reads from
+// crypto/rand in batches, so that most fields don't need a read of their own.
+type nonceSource struct {
+	mu  sync.Mutex
+	buf [4096]byte
+	off int
+}
+
+var nonces = &nonceSource{off: 4096}
+
+func (s *nonceSource) read(dst []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(dst) > 0 {
+		if s.off == len(s.buf) {
+			if _, err := io.ReadFull(rand.Reader, s.buf[:]); err != nil {
+				return errors.Wrap(err, "nonceSource.io.ReadFull")
+			}
+			s.off = 0
+		}
+		n := copy(dst, s.buf[s.off:])
+		// a nonce is handed out once
+		for i := s.off; i < s.off+n; i++ {
+			s.buf[i] = 0
+		}
+		s.off += n
+		dst = dst[n:]
+	}
+	return nil
+}
+
+func encodedLen(encoding string, n int) int {
+	switch encoding {
+	case encodingBase64:
+		return base64.StdEncoding.EncodedLen(n)
+	case encodingBase64URL:
+		return base64.URLEncoding.EncodedLen(n)
+	default:
+		return hex.EncodedLen(n)
+	}
+}
+
+func encode(encoding string, dst, src []byte) {
+	switch encoding {
+	case encodingBase64:
+		base64.StdEncoding.Encode(dst, src)
+	case encodingBase64URL:
+		base64.URLEncoding.Encode(dst, src)
+	default:
+		hex.Encode(dst, src)
+	}
+}
+
+func decodedLen(encoding string, n int) int {
+	switch encoding {
+	case encodingBase64:
+		return base64.StdEncoding.DecodedLen(n)
+	case encodingBase64URL:
+		return base64.URLEncoding.DecodedLen(n)
+	default:
+		return hex.DecodedLen(n)
+	}
+}
+
+func decode(encoding string, dst, src []byte) (int, error) {
+	var (
+		n   int
+		err error
+	)
+	switch encoding {
+	case encodingBase64:
+		n, err = base64.StdEncoding.Decode(dst, src)
+	case encodingBase64URL:
+		n, err = base64.URLEncoding.Decode(dst, src)
+	default:
+		n, err = hex.Decode(dst, src)
+	}
+	if err != nil {
+		return 0, wrapError(ErrMalformedCiphertext, err, "decode."+encoding)
+	}
+	return n, nil
+}
+
+// sealString encrypts plainText with s and returns prefix, the ciphertext in
+// the given encoding and postfix as one string. The string is its only
+// allocation.
+func sealString(s sealer, encoding, prefix, postfix, plainText string) (string, error) {
+	size := s.sealedLen(len(plainText))
+	buf := getBuffer(size + len(prefix) + encodedLen(encoding, size) + len(postfix))
+	defer buf.free()
+	copy(buf.b[s.prefixLen():], plainText)
+	return buf.sealText(s, size, len(plainText), encoding, prefix, postfix)
+}
+
+// sealBytes is sealString for plain text held in a byte slice
+func sealBytes(s sealer, encoding string, plainText []byte) (string, error) {
+	size := s.sealedLen(len(plainText))
+	buf := getBuffer(size + encodedLen(encoding, size))
+	defer buf.free()
+	copy(buf.b[s.prefixLen():], plainText)
+	return buf.sealText(s, size, len(plainText), encoding, "", "")
+}
+
+// sealText seals the n bytes of plain text in the buffer, which holds the
+// size bytes of ciphertext followed by room for the text.
+func (buf *buffer) sealText(s sealer, size, n int, encoding, prefix, postfix string) (string, error) {
+	raw := buf.b[:size]
+	if err := s.seal(raw, n); err != nil {
+		return "", err
+	}
+	text := buf.b[size:]
+	i := copy(text, prefix)
+	encode(encoding, text[i:], raw)
+	copy(text[i+encodedLen(encoding, size):], postfix)
+	return string(text), nil
+}
+
+// openString decodes cipherText from the given encoding and decrypts it with
+// s. The plain text string is its only allocation.
+func openString(s sealer, encoding, cipherText string) (string, error) {
+	buf := getBuffer(len(cipherText) + decodedLen(encoding, len(cipherText)))
+	defer buf.free()
+	src := buf.b[:len(cipherText)]
+	copy(src, cipherText)
+	return buf.openText(s, encoding, src)
+}
+
+// openBytes is openString for ciphertext held in a byte slice
+func openBytes(s sealer, encoding string, cipherText []byte) (string, error) {
+	buf := getBuffer(decodedLen(encoding, len(cipherText)))
+	defer buf.free()
+	return buf.openText(s, encoding, cipherText)
+}
+
+// openText decodes src into the end of the buffer and decrypts it there
+func (buf *buffer) openText(s sealer, encoding string, src []byte) (string, error) {
+	raw := buf.b[len(buf.b)-decodedLen(encoding, len(src)):]
+	n, err := decode(encoding, raw, src)
+	if err != nil {
+		return "", err
+	}
+	plainText, err := s.open(raw[:n])
+	if err != nil {
+		return "", err
+	}
+	return string(plainText), nil
+}
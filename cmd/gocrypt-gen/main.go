@@ -0,0 +1,449 @@
+// Command gocrypt-gen generates reflection-free EncryptFields and
+// DecryptFields methods for the struct types of a package, which
+// gocrypt.Option.Encrypt and Decrypt use instead of walking the value with
+// reflection.
+//
+// Usage, from a file of the package:
+//
+//	//go:generate gocrypt-gen -type User,Order
+//
+// Without -type, every struct type with gocrypt tags is generated. The
+// generator only covers types whose behaviour it can reproduce exactly:
+// tagged string and []string fields with the omitempty, enc and keyid
+// options, and nested structs of the same package held by value, pointer,
+// or in a slice. Any other type is skipped with a note on stderr and keeps
+// using reflection. Like reflection, generated methods transform a struct or
+// slice shared within a value once.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultOutput = "gocrypt_gen.go"
+
+func main() {
+	typeNames := flag.String("type", "", "comma separated list of type names, all tagged struct types when empty")
+	output := flag.String("output", defaultOutput, "output file name, relative to the package directory")
+	flag.Parse()
+
+	dir := "."
+	if flag.NArg() > 0 {
+		dir = flag.Arg(0)
+	}
+	var names []string
+	if *typeNames != "" {
+		names = strings.Split(*typeNames, ",")
+	}
+
+	src, skipped, err := generate(dir, filepath.Base(*output), names)
+	for _, note := range skipped {
+		fmt.Fprintln(os.Stderr, "gocrypt-gen: skipping "+note)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gocrypt-gen: "+err.Error())
+		os.Exit(1)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, *output), src, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, "gocrypt-gen: "+err.Error())
+		os.Exit(1)
+	}
+}
+
+// fieldKind is how a generated method handles a field
+type fieldKind int
+
+const (
+	kindString fieldKind = iota
+	kindStringSlice
+	kindStruct      // a nested struct, or a pointer to one
+	kindStructSlice // a slice of nested structs, or of pointers to them
+)
+
+type fieldPlan struct {
+	kind      fieldKind
+	name      string
+	tag       string // the gocrypt tag, passed to EncryptValue and DecryptValue
+	algo      string
+	omitEmpty bool
+	nested    string // type of a nested struct
+}
+
+type typePlan struct {
+	name   string
+	fields []fieldPlan
+}
+
+// analyzer decides which types of a package can be generated
+type analyzer struct {
+	specs   map[string]ast.Expr // package level types
+	plans   map[string]*typePlan
+	reasons map[string]string // why a type can't be generated
+	active  map[string]bool   // types being analyzed, to find recursive types
+}
+
+// generate returns the source of the methods of the types names of the
+// package in dir, or of all its tagged struct types, and why some types were
+// skipped.
+func generate(dir, output string, names []string) ([]byte, []string, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go") && fi.Name() != output
+	}, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(pkgs) != 1 {
+		return nil, nil, fmt.Errorf("%s must hold exactly one package, found %d", dir, len(pkgs))
+	}
+
+	var pkg *ast.Package
+	for _, p := range pkgs {
+		pkg = p
+	}
+	a := &analyzer{
+		specs:   make(map[string]ast.Expr),
+		plans:   make(map[string]*typePlan),
+		reasons: make(map[string]string),
+		active:  make(map[string]bool),
+	}
+	for _, file := range pkg.Files {
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				typeSpec := spec.(*ast.TypeSpec)
+				a.specs[typeSpec.Name.Name] = typeSpec.Type
+			}
+		}
+	}
+
+	explicit := len(names) > 0
+	if !explicit {
+		for name, expr := range a.specs {
+			if _, ok := expr.(*ast.StructType); ok {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	var skipped []string
+	for _, name := range names {
+		expr, ok := a.specs[name]
+		if !ok {
+			return nil, skipped, fmt.Errorf("type %s not found in %s", name, dir)
+		}
+		if _, ok := expr.(*ast.StructType); !ok {
+			return nil, skipped, fmt.Errorf("type %s is not a struct", name)
+		}
+		if plan := a.analyze(name); plan == nil {
+			skipped = append(skipped, name+": "+a.reasons[name])
+		} else if len(plan.fields) == 0 && explicit {
+			skipped = append(skipped, name+": no tagged fields")
+		}
+	}
+
+	// every generated type and the nested types it calls, by name
+	var plans []*typePlan
+	for _, plan := range a.plans {
+		if plan != nil && len(plan.fields) > 0 {
+			plans = append(plans, plan)
+		}
+	}
+	sort.Slice(plans, func(i, j int) bool { return plans[i].name < plans[j].name })
+	src, err := emit(pkg.Name, plans)
+	return src, skipped, err
+}
+
+// analyze returns the plan of the struct type name, or nil when it can't be
+// generated.
+func (a *analyzer) analyze(name string) *typePlan {
+	if plan, ok := a.plans[name]; ok {
+		return plan
+	}
+	if a.active[name] {
+		a.reasons[name] = "recursive type"
+		return nil
+	}
+	a.active[name] = true
+	defer delete(a.active, name)
+
+	plan, reason := a.analyzeStruct(name, a.specs[name].(*ast.StructType))
+	if reason != "" {
+		a.reasons[name] = reason
+		plan = nil
+	}
+	a.plans[name] = plan
+	return plan
+}
+
+func (a *analyzer) analyzeStruct(name string, st *ast.StructType) (*typePlan, string) {
+	plan := &typePlan{name: name}
+	for _, field := range st.Fields.List {
+		if len(field.Names) == 0 {
+			return nil, "embedded field " + exprString(field.Type)
+		}
+		tag, tagged := "", false
+		if field.Tag != nil {
+			raw, err := strconv.Unquote(field.Tag.Value)
+			if err != nil {
+				return nil, "malformed tag " + field.Tag.Value
+			}
+			tag, tagged = reflect.StructTag(raw).Lookup("gocrypt")
+		}
+
+		for _, ident := range field.Names {
+			if !ident.IsExported() || (tagged && tag == "-") {
+				continue
+			}
+			var fieldPlans []fieldPlan
+			var reason string
+			if tagged {
+				fieldPlans, reason = a.taggedField(ident.Name, tag, field.Type)
+			} else {
+				fieldPlans, reason = a.untaggedField(ident.Name, field.Type)
+			}
+			if reason != "" {
+				return nil, ident.Name + ": " + reason
+			}
+			plan.fields = append(plan.fields, fieldPlans...)
+		}
+	}
+	return plan, ""
+}
+
+func (a *analyzer) taggedField(name, tag string, expr ast.Expr) ([]fieldPlan, string) {
+	parts := strings.Split(tag, ",")
+	plan := fieldPlan{name: name, tag: tag, algo: strings.TrimSpace(parts[0])}
+	for _, mod := range parts[1:] {
+		mod = strings.TrimSpace(mod)
+		switch {
+		case mod == "omitempty":
+			plan.omitEmpty = true
+		case strings.HasPrefix(mod, "enc="), strings.HasPrefix(mod, "keyid="):
+		default:
+			return nil, "tag option " + strconv.Quote(mod) + " needs reflection"
+		}
+	}
+
+	switch {
+	case isIdent(expr, "string"):
+		plan.kind = kindString
+	case isSlice(expr) && isIdent(expr.(*ast.ArrayType).Elt, "string"):
+		plan.kind = kindStringSlice
+	default:
+		return nil, "tag on " + exprString(expr) + " needs reflection"
+	}
+	return []fieldPlan{plan}, ""
+}
+
+// untaggedField returns the plan of a field without a tag: a call into a
+// nested struct, or nothing for leaves reflection wouldn't touch either.
+func (a *analyzer) untaggedField(name string, expr ast.Expr) ([]fieldPlan, string) {
+	kind, inner := kindStruct, expr
+	if isSlice(inner) {
+		kind, inner = kindStructSlice, inner.(*ast.ArrayType).Elt
+	}
+	if star, ok := inner.(*ast.StarExpr); ok {
+		inner = star.X
+	}
+
+	ident, ok := inner.(*ast.Ident)
+	if !ok || a.specs[ident.Name] == nil {
+		if a.isLeaf(expr) {
+			return nil, ""
+		}
+		return nil, "field of type " + exprString(expr) + " needs reflection"
+	}
+	if _, ok := a.specs[ident.Name].(*ast.StructType); !ok {
+		if a.isLeaf(expr) {
+			return nil, ""
+		}
+		return nil, "field of type " + exprString(expr) + " needs reflection"
+	}
+
+	nested := a.analyze(ident.Name)
+	if nested == nil {
+		return nil, "nested type " + ident.Name + ": " + a.reasons[ident.Name]
+	}
+	if len(nested.fields) == 0 {
+		return nil, ""
+	}
+	return []fieldPlan{{kind: kind, name: name, nested: ident.Name}}, ""
+}
+
+// leafTypes are types of other packages that never hold gocrypt tags
+var leafTypes = map[string]bool{
+	"time.Time": true, "time.Duration": true, "json.Number": true, "json.RawMessage": true,
+	"sql.NullString": true, "sql.NullInt64": true, "sql.NullInt32": true, "sql.NullFloat64": true,
+	"sql.NullBool": true, "sql.NullTime": true,
+}
+
+// isLeaf reports whether a value of expr can't hold a struct reflection
+// would walk into: basic non-interface types, named non-struct types of the
+// package, known leaf types, and pointers, slices, arrays and maps of those.
+// Funcs and channels are never walked.
+func (a *analyzer) isLeaf(expr ast.Expr) bool {
+	switch e := expr.(type) {
+	case *ast.Ident:
+		if spec, ok := a.specs[e.Name]; ok {
+			if _, isStruct := spec.(*ast.StructType); isStruct {
+				return false
+			}
+			return a.isLeaf(spec)
+		}
+		// error and any are interfaces, reflection walks what they hold
+		obj, basic := types.Universe.Lookup(e.Name).(*types.TypeName)
+		return basic && !types.IsInterface(obj.Type())
+	case *ast.SelectorExpr:
+		return leafTypes[exprString(e)]
+	case *ast.StarExpr:
+		return a.isLeaf(e.X)
+	case *ast.ArrayType:
+		return a.isLeaf(e.Elt)
+	case *ast.MapType:
+		return a.isLeaf(e.Key) && a.isLeaf(e.Value)
+	case *ast.FuncType, *ast.ChanType:
+		return true
+	default:
+		return false
+	}
+}
+
+func isIdent(expr ast.Expr, name string) bool {
+	ident, ok := expr.(*ast.Ident)
+	return ok && ident.Name == name
+}
+
+func isSlice(expr ast.Expr) bool {
+	array, ok := expr.(*ast.ArrayType)
+	return ok && array.Len == nil
+}
+
+func exprString(expr ast.Expr) string {
+	var buf bytes.Buffer
+	_ = format.Node(&buf, token.NewFileSet(), expr)
+	return buf.String()
+}
+
+// emit returns the formatted source of the generated methods
+func emit(pkgName string, plans []*typePlan) ([]byte, error) {
+	var b bytes.Buffer
+	usesStrconv := false
+	for _, plan := range plans {
+		for _, field := range plan.fields {
+			if field.kind == kindStringSlice || field.kind == kindStructSlice {
+				usesStrconv = true
+			}
+		}
+	}
+
+	fmt.Fprintf(&b, "// Code generated by gocrypt-gen. DO NOT EDIT.\n\npackage %s\n\nimport (\n", pkgName)
+	if usesStrconv {
+		b.WriteString("\t\"strconv\"\n\n")
+	}
+	b.WriteString("\t\"github.com/firdasafridi/gocrypt\"\n)\n")
+
+	for _, plan := range plans {
+		emitType(&b, plan)
+	}
+	return format.Source(b.Bytes())
+}
+
+func emitType(b *bytes.Buffer, plan *typePlan) {
+	fmt.Fprintf(b, `
+// EncryptFields encrypts the tagged fields of v without reflection
+func (v *%[1]s) EncryptFields(opt *gocrypt.Option) error {
+	return v.gocryptFields(gocrypt.NewFieldTransformer(opt.EncryptValue))
+}
+
+// DecryptFields decrypts the tagged fields of v without reflection
+func (v *%[1]s) DecryptFields(opt *gocrypt.Option) error {
+	return v.gocryptFields(gocrypt.NewFieldTransformer(opt.DecryptValue))
+}
+
+func (v *%[1]s) gocryptFields(t *gocrypt.FieldTransformer) error {
+	if v == nil || t.Seen(v, 0) {
+		return nil
+	}
+`, plan.name)
+
+	for _, field := range plan.fields {
+		if field.kind == kindString || field.kind == kindStringSlice {
+			b.WriteString("\tvar (\n\t\ts   string\n\t\terr error\n\t)\n")
+			break
+		}
+	}
+
+	for _, field := range plan.fields {
+		tag, algo := strconv.Quote(field.tag), strconv.Quote(field.algo)
+		switch field.kind {
+		case kindString:
+			transform := fmt.Sprintf(`if s, err = t.Transform(%[2]s, v.%[1]s); err != nil {
+	return &gocrypt.FieldError{Path: %[4]q, Tag: %[3]s, Err: err}
+}
+v.%[1]s = s
+`, field.name, tag, algo, field.name)
+			if field.omitEmpty {
+				transform = fmt.Sprintf("if v.%s != \"\" {\n%s}\n", field.name, indent(transform))
+			}
+			b.WriteString(indent(transform))
+		case kindStringSlice:
+			skip := ""
+			if field.omitEmpty {
+				skip = fmt.Sprintf("\tif v.%s[i] == \"\" {\n\t\tcontinue\n\t}\n", field.name)
+			}
+			// a slice shared within the value is transformed once
+			loop := fmt.Sprintf(`for i := range v.%[1]s {
+%[4]s	if s, err = t.Transform(%[2]s, v.%[1]s[i]); err != nil {
+		return &gocrypt.FieldError{Path: "%[1]s[" + strconv.Itoa(i) + "]", Tag: %[3]s, Err: err}
+	}
+	v.%[1]s[i] = s
+}
+`, field.name, tag, algo, skip)
+			b.WriteString(indent(fmt.Sprintf("if len(v.%[1]s) > 0 && !t.Seen(&v.%[1]s[0], len(v.%[1]s)) {\n%[2]s}\n",
+				field.name, indent(loop))))
+		case kindStruct:
+			fmt.Fprintf(b, `	if err := v.%[1]s.gocryptFields(t); err != nil {
+		return gocrypt.NestFieldError(%[1]q, err)
+	}
+`, field.name)
+		case kindStructSlice:
+			fmt.Fprintf(b, `	for i := range v.%[1]s {
+		if err := v.%[1]s[i].gocryptFields(t); err != nil {
+			return gocrypt.NestFieldError("%[1]s["+strconv.Itoa(i)+"]", err)
+		}
+	}
+`, field.name)
+		}
+	}
+	b.WriteString("\treturn nil\n}\n")
+}
+
+// indent indents every line of block by a tab
+func indent(block string) string {
+	lines := strings.SplitAfter(block, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = "\t" + line
+		}
+	}
+	return strings.Join(lines, "")
+}
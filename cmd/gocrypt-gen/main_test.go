@@ -0,0 +1,314 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testSource = `package sample
+
+import "time"
+
+type User struct {
+	Name    string   ` + "`gocrypt:\"aes\"`" + `
+	Phone   string   ` + "`gocrypt:\"des,omitempty,enc=base64\"`" + `
+	Emails  []string ` + "`gocrypt:\"aes\"`" + `
+	Skipped string   ` + "`gocrypt:\"-\"`" + `
+	Age     int
+	Born    time.Time
+	Home    *Address
+	Others  []Address
+	private string ` + "`gocrypt:\"aes\"`" + `
+}
+
+type Address struct {
+	Street string ` + "`gocrypt:\"rc4\"`" + `
+}
+
+type Plain struct {
+	Name string
+}
+
+type Scalar struct {
+	Age    int    ` + "`gocrypt:\"aes,into=AgeEnc\"`" + `
+	AgeEnc string
+}
+
+type Holder struct {
+	Payload interface{}
+}
+
+type AnyHolder struct {
+	Name    string ` + "`gocrypt:\"aes\"`" + `
+	Payload any
+}
+
+type Node struct {
+	Value string ` + "`gocrypt:\"aes\"`" + `
+	Next  *Node
+}
+
+type Outer struct {
+	Inner Scalar
+}
+`
+
+func TestGenerate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocrypt-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "sample.go"), []byte(testSource), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	src, skipped, err := generate(dir, defaultOutput, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(src)
+	for _, want := range []string{
+		"func (v *User) EncryptFields(opt *gocrypt.Option) error",
+		"func (v *Address) DecryptFields(opt *gocrypt.Option) error",
+		`if v.Phone != "" {`,
+		`t.Transform("des,omitempty,enc=base64", v.Phone)`,
+		`if v == nil || t.Seen(v, 0) {`,
+		`if len(v.Emails) > 0 && !t.Seen(&v.Emails[0], len(v.Emails)) {`,
+		`if err := v.Home.gocryptFields(t); err != nil {`,
+		`return gocrypt.NestFieldError("Others["+strconv.Itoa(i)+"]", err)`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("generated source lacks %q:\n%s", want, out)
+		}
+	}
+	for _, unwanted := range []string{"Skipped", "private", "Plain", "v.Age"} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("generated source mentions %q", unwanted)
+		}
+	}
+
+	wantSkipped := []string{
+		"AnyHolder: Payload: field of type any needs reflection",
+		"Holder: Payload: field of type interface{} needs reflection",
+		"Node: Next: nested type Node: recursive type",
+		`Outer: Inner: nested type Scalar: Age: tag option "into=AgeEnc" needs reflection`,
+		`Scalar: Age: tag option "into=AgeEnc" needs reflection`,
+	}
+	if got := strings.Join(skipped, "\n"); got != strings.Join(wantSkipped, "\n") {
+		t.Errorf("skipped:\n%s\nwant:\n%s", got, strings.Join(wantSkipped, "\n"))
+	}
+
+	if _, _, err := generate(dir, defaultOutput, []string{"Missing"}); err == nil {
+		t.Error("generate of a missing type succeeded")
+	}
+}
+
+const parityFixture = `package parity
+
+type User struct {
+	Name    string   ` + "`gocrypt:\"det\"`" + `
+	Phone   string   ` + "`gocrypt:\"det,omitempty\"`" + `
+	Code    string   ` + "`gocrypt:\"det,enc=base64\"`" + `
+	Rotated string   ` + "`gocrypt:\"det,keyid=k2\"`" + `
+	Emails  []string ` + "`gocrypt:\"det,omitempty\"`" + `
+	Aliases []string ` + "`gocrypt:\"det\"`" + `
+	Spare   []string ` + "`gocrypt:\"det,omitempty\"`" + `
+	Home    *Address
+	Billing *Address
+	Work    Address
+	Others  []Address
+}
+
+type Address struct {
+	Street string ` + "`gocrypt:\"det\"`" + `
+}
+
+type Holder struct {
+	Name    string ` + "`gocrypt:\"det\"`" + `
+	Payload any
+}
+`
+
+// parityTest runs in the generated package and checks every fixture against
+// reflection, which a call option forces.
+const parityTest = `package parity
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/firdasafridi/gocrypt"
+)
+
+// detOpt prefixes the plain text, so that both paths produce the same output
+type detOpt struct{ prefix string }
+
+func (o detOpt) Encrypt(p []byte) (string, error) { return o.prefix + string(p), nil }
+
+func (o detOpt) Decrypt(c []byte) (string, error) {
+	if !strings.HasPrefix(string(c), o.prefix) {
+		return "", errors.New("not " + o.prefix + " ciphertext")
+	}
+	return strings.TrimPrefix(string(c), o.prefix), nil
+}
+
+func (o detOpt) EncryptRaw(p []byte) ([]byte, error) { return append([]byte(o.prefix), p...), nil }
+
+func (o detOpt) DecryptRaw(c []byte) ([]byte, error) {
+	if !bytes.HasPrefix(c, []byte(o.prefix)) {
+		return nil, errors.New("not " + o.prefix + " ciphertext")
+	}
+	return c[len(o.prefix):], nil
+}
+
+func fixtures() []*User {
+	return []*User{
+		{},
+		{Name: "bruce", Phone: "+62123", Code: "x1", Rotated: "r", Emails: []string{"a@wayne.com", ""},
+			Aliases: []string{"", "batman"}, Home: &Address{Street: "manor"}, Work: Address{Street: "tower"},
+			Others: []Address{{Street: "cave"}, {}}},
+		{Name: "", Phone: "", Emails: []string{}, Others: []Address{}},
+		shared(),
+	}
+}
+
+// shared returns a user whose pointers and slices are shared, they are
+// transformed once
+func shared() *User {
+	home := &Address{Street: "manor"}
+	emails := []string{"a@wayne.com", "b@wayne.com"}
+	return &User{Emails: emails, Spare: emails, Home: home, Billing: home}
+}
+
+func check(t *testing.T, name string, i int, generated, reflected *User, genErr, refErr error) {
+	t.Helper()
+	if fmt.Sprint(genErr) != fmt.Sprint(refErr) {
+		t.Errorf("%s fixture %d: generated err = %v, reflection err = %v", name, i, genErr, refErr)
+	}
+	var genField, refField *gocrypt.FieldError
+	if errors.As(genErr, &genField) != errors.As(refErr, &refField) ||
+		(genField != nil && (genField.Path != refField.Path || genField.Tag != refField.Tag)) {
+		t.Errorf("%s fixture %d: generated FieldError = %+v, reflection FieldError = %+v", name, i, genField, refField)
+	}
+	if !reflect.DeepEqual(generated, reflected) {
+		t.Errorf("%s fixture %d: generated = %+v, reflection = %+v", name, i, generated, reflected)
+	}
+}
+
+// a type holding any is left to reflection, which walks the held value
+func TestParityAny(t *testing.T) {
+	opt := gocrypt.New(&gocrypt.Option{Custom: map[string]gocrypt.GocryptOption{"det": detOpt{"det:"}}})
+	var holder interface{} = &Holder{Name: "n", Payload: &Address{Street: "manor"}}
+	if _, ok := holder.(gocrypt.FieldsEncrypter); ok {
+		t.Fatal("Holder has generated methods")
+	}
+	if err := opt.Encrypt(holder); err != nil {
+		t.Fatal(err)
+	}
+	if got := holder.(*Holder).Payload.(*Address).Street; got != "det:manor" {
+		t.Errorf("Payload.Street = %q, want it encrypted", got)
+	}
+}
+
+func TestParity(t *testing.T) {
+	opt := gocrypt.New(&gocrypt.Option{
+		Custom: map[string]gocrypt.GocryptOption{"det": detOpt{"det:"}},
+		Keys:   map[string]gocrypt.GocryptOption{"k2": detOpt{"k2:"}},
+	})
+	force := gocrypt.Workers(1)
+
+	for i := range fixtures() {
+		generated, reflected := fixtures()[i], fixtures()[i]
+		check(t, "Encrypt", i, generated, reflected, generated.EncryptFields(opt), opt.Encrypt(reflected, force))
+		check(t, "Decrypt", i, generated, reflected, generated.DecryptFields(opt), opt.Decrypt(reflected, force))
+		if !reflect.DeepEqual(generated, fixtures()[i]) {
+			t.Errorf("round trip of fixture %d = %+v", i, generated)
+		}
+	}
+
+	// a value that isn't ciphertext fails at the same path on both sides
+	for _, corrupt := range []func(u *User){
+		func(u *User) { u.Name = "plain" },
+		func(u *User) { u.Code = "!!!" },
+		func(u *User) { u.Emails[0] = "plain" },
+		func(u *User) { u.Home.Street = "plain" },
+		func(u *User) { u.Others[1].Street = "plain" },
+	} {
+		generated, reflected := fixtures()[1], fixtures()[1]
+		if err := opt.Encrypt(generated, force); err != nil {
+			t.Fatal(err)
+		}
+		if err := opt.Encrypt(reflected, force); err != nil {
+			t.Fatal(err)
+		}
+		corrupt(generated)
+		corrupt(reflected)
+		check(t, "corrupt Decrypt", 1, generated, reflected, generated.DecryptFields(opt), opt.Decrypt(reflected, force))
+	}
+}
+`
+
+// TestGenerateMatchesReflection builds generated code against this module and
+// checks that it transforms like reflection does.
+func TestGenerateMatchesReflection(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds a module")
+	}
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+	root, err := filepath.Abs(filepath.Join("..", ".."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	goSum, err := ioutil.ReadFile(filepath.Join(root, "go.sum"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "gocrypt-gen-parity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	goMod := "module parity\n\ngo 1.18\n\nrequire github.com/firdasafridi/gocrypt v0.0.0\n\n" +
+		"replace github.com/firdasafridi/gocrypt => " + root + "\n"
+	files := map[string][]byte{
+		"go.mod":         []byte(goMod),
+		"go.sum":         goSum,
+		"fixture.go":     []byte(parityFixture),
+		"parity_test.go": []byte(parityTest),
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	src, skipped, err := generate(dir, defaultOutput, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Holder: Payload: field of type any needs reflection"; len(skipped) != 1 || skipped[0] != want {
+		t.Fatalf("generator skipped %v, want only %q", skipped, want)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, defaultOutput), src, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(goBin, "test", "-count=1", ".")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("generated package fails:\n%s", out)
+	}
+}
@@ -4,3 +4,17 @@ const (
 	// GOCRYPT is variable tag field for gocrypt
 	GOCRYPT = "gocrypt"
 )
+
+// Tag values of the built-in algorithms
+const (
+	// AES is the tag value handled by Option.AESOpt
+	AES = "aes"
+	// AES256GCM is the tag value handled by Option.AES256GCMOpt
+	AES256GCM = "aes256gcm"
+	// DES is the tag value handled by Option.DESOpt
+	DES = "des"
+	// RC4 is the tag value handled by Option.RC4Opt
+	RC4 = "rc4"
+	// DEFAULT is the tag value for Option.DefaultAlgorithm, like an empty tag
+	DEFAULT = "default"
+)
@@ -0,0 +1,95 @@
+package gocrypt
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// copier deep copies a value. Pointers and maps reached more than once are
+// copied once, so shared data and cycles keep their shape in the copy.
+type copier struct {
+	ptrs map[visit]reflect.Value
+	maps map[visit]reflect.Value
+}
+
+func newCopier() *copier {
+	return &copier{
+		ptrs: make(map[visit]reflect.Value),
+		maps: make(map[visit]reflect.Value),
+	}
+}
+
+// copyValue returns a deep copy of src. Unexported struct fields are copied
+// shallowly, since gocrypt never writes through them, except embedded ones
+// holding structs, whose exported fields gocrypt does write.
+func (c *copier) copyValue(src reflect.Value) reflect.Value {
+	switch src.Kind() {
+	case reflect.Ptr:
+		if src.IsNil() {
+			return src
+		}
+		key := visit{ptr: src.Pointer(), typ: src.Type()}
+		if dst, ok := c.ptrs[key]; ok {
+			return dst
+		}
+		dst := reflect.New(src.Type().Elem())
+		c.ptrs[key] = dst
+		dst.Elem().Set(c.copyValue(src.Elem()))
+		return dst
+	case reflect.Interface:
+		if src.IsNil() {
+			return src
+		}
+		dst := reflect.New(src.Type()).Elem()
+		dst.Set(c.copyValue(src.Elem()))
+		return dst
+	case reflect.Slice:
+		if src.IsNil() {
+			return src
+		}
+		dst := reflect.MakeSlice(src.Type(), src.Len(), src.Len())
+		for i := 0; i < src.Len(); i++ {
+			dst.Index(i).Set(c.copyValue(src.Index(i)))
+		}
+		return dst
+	case reflect.Array:
+		dst := reflect.New(src.Type()).Elem()
+		for i := 0; i < src.Len(); i++ {
+			dst.Index(i).Set(c.copyValue(src.Index(i)))
+		}
+		return dst
+	case reflect.Map:
+		if src.IsNil() {
+			return src
+		}
+		key := visit{ptr: src.Pointer(), typ: src.Type()}
+		if dst, ok := c.maps[key]; ok {
+			return dst
+		}
+		dst := reflect.MakeMapWithSize(src.Type(), src.Len())
+		c.maps[key] = dst
+		for _, mapKey := range src.MapKeys() {
+			dst.SetMapIndex(mapKey, c.copyValue(src.MapIndex(mapKey)))
+		}
+		return dst
+	case reflect.Struct:
+		dst := reflect.New(src.Type()).Elem()
+		dst.Set(src)
+		for i := 0; i < dst.NumField(); i++ {
+			field := dst.Field(i)
+			if !field.CanSet() {
+				structField := dst.Type().Field(i)
+				if !structField.Anonymous || !containsStruct(structField.Type) {
+					continue
+				}
+				// dst holds a shallow copy of the field, reach it through
+				// its address to copy it deeply
+				field = reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem()
+			}
+			field.Set(c.copyValue(field))
+		}
+		return dst
+	default:
+		return src
+	}
+}
@@ -0,0 +1,129 @@
+package gocrypt
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// ContextOption is implemented by options that need the context of
+// EncryptContext and DecryptContext, e.g. remote or KMS backed options that
+// honour deadlines or read request-scoped data. Option uses it instead of
+// Encrypt and Decrypt, except for fields with the enc tag option, which go
+// through RawOption.
+type ContextOption interface {
+	EncryptContext(ctx context.Context, plainText []byte) (string, error)
+	DecryptContext(ctx context.Context, cipherText []byte) (string, error)
+}
+
+// RawOption is implemented by options that can encrypt and decrypt without
+// encoding the ciphertext as text. It lets a field pick its own encoding with
+// the enc tag option. All the built-in options implement it.
+type RawOption interface {
+	EncryptRaw(plainText []byte) ([]byte, error)
+	DecryptRaw(cipherText []byte) ([]byte, error)
+}
+
+// Encodings of the enc tag option
+const (
+	encodingHex       = "hex"
+	encodingBase64    = "base64"
+	encodingBase64URL = "base64url"
+)
+
+func isEncoding(encoding string) bool {
+	switch encoding {
+	case encodingHex, encodingBase64, encodingBase64URL:
+		return true
+	default:
+		return false
+	}
+}
+
+func encodeToString(encoding string, src []byte) string {
+	switch encoding {
+	case encodingBase64:
+		return base64.StdEncoding.EncodeToString(src)
+	case encodingBase64URL:
+		return base64.URLEncoding.EncodeToString(src)
+	default:
+		return hex.EncodeToString(src)
+	}
+}
+
+func decodeString(encoding string, s string) ([]byte, error) {
+	var (
+		dst []byte
+		err error
+	)
+	switch encoding {
+	case encodingBase64:
+		dst, err = base64.StdEncoding.DecodeString(s)
+	case encodingBase64URL:
+		dst, err = base64.URLEncoding.DecodeString(s)
+	default:
+		dst, err = hex.DecodeString(s)
+	}
+	if err != nil {
+		return nil, wrapError(ErrMalformedCiphertext, err, "decodeString."+encoding)
+	}
+	return dst, nil
+}
+
+// encryptString encrypts plainText with gocryptOpt. A non-empty encoding
+// replaces the option's own encoding of the ciphertext.
+func encryptString(ctx context.Context, gocryptOpt GocryptOption, encoding string, plainText string) (string, error) {
+	if s, ok := sealerOf(gocryptOpt); ok {
+		return sealString(s, sealEncoding(s, encoding), "", "", plainText)
+	}
+	if encoding == "" {
+		if ctxOpt, ok := gocryptOpt.(ContextOption); ok {
+			return ctxOpt.EncryptContext(ctx, []byte(plainText))
+		}
+		return gocryptOpt.Encrypt([]byte(plainText))
+	}
+	rawOpt, ok := gocryptOpt.(RawOption)
+	if !ok {
+		return "", newError(ErrInvalidTag, "enc="+encoding+" needs an option implementing RawOption")
+	}
+	cipherText, err := rawOpt.EncryptRaw([]byte(plainText))
+	if err != nil {
+		return "", err
+	}
+	return encodeToString(encoding, cipherText), nil
+}
+
+// decryptString decrypts cipherText with gocryptOpt, see encryptString.
+func decryptString(ctx context.Context, gocryptOpt GocryptOption, encoding string, cipherText string) (string, error) {
+	if s, ok := sealerOf(gocryptOpt); ok {
+		return openString(s, sealEncoding(s, encoding), cipherText)
+	}
+	if encoding == "" {
+		if ctxOpt, ok := gocryptOpt.(ContextOption); ok {
+			return ctxOpt.DecryptContext(ctx, []byte(cipherText))
+		}
+		return gocryptOpt.Decrypt([]byte(cipherText))
+	}
+	rawOpt, ok := gocryptOpt.(RawOption)
+	if !ok {
+		return "", newError(ErrInvalidTag, "enc="+encoding+" needs an option implementing RawOption")
+	}
+	cipherBytes, err := decodeString(encoding, cipherText)
+	if err != nil {
+		return "", err
+	}
+	plainText, err := rawOpt.DecryptRaw(cipherBytes)
+	if err != nil {
+		return "", err
+	}
+	return string(plainText), nil
+}
+
+// sealEncoding returns the encoding of a built-in option's ciphertext, its
+// own unless the field names one
+func sealEncoding(s sealer, encoding string) string {
+	if encoding == "" {
+		return s.textEncoding()
+	}
+	return encoding
+}
@@ -0,0 +1,153 @@
+package gocrypt
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Sentinel errors returned by Option and the built-in options, check them with errors.Is
+var (
+	// ErrNotInitialized means the option for an algorithm is nil or was not created by its constructor
+	ErrNotInitialized = errors.New("option is not initialized")
+	// ErrMalformedCiphertext means the ciphertext can't be decoded or has the wrong length,
+	// e.g. a corrupted value or a value that was never encrypted
+	ErrMalformedCiphertext = errors.New("malformed ciphertext")
+	// ErrAuthenticationFailed means the ciphertext is well formed but doesn't verify,
+	// usually a wrong key. For des it is reported when the padding check fails
+	ErrAuthenticationFailed = errors.New("authentication failed")
+	// ErrUnknownAlgorithm means a tag names an algorithm that is neither built-in nor in Option.Custom
+	ErrUnknownAlgorithm = errors.New("unknown algorithm")
+	// ErrUnsupportedType means a tag is on a field gocrypt can't transform, reported in strict mode
+	ErrUnsupportedType = errors.New("unsupported type")
+	// ErrInvalidTag means a tag has an unknown or malformed option, reported in strict mode
+	ErrInvalidTag = errors.New("invalid tag")
+	// ErrNotAddressable means the value passed to Encrypt/Decrypt can't be modified, reported in strict mode
+	ErrNotAddressable = errors.New("value is not addressable")
+	// ErrUnknownField means a field path passed to Only or Except doesn't name a field gocrypt transforms
+	ErrUnknownField = errors.New("unknown field")
+)
+
+// FieldError records the failure to encrypt or decrypt a single field
+type FieldError struct {
+	Path string // path from the value passed to Encrypt/Decrypt, e.g. Items[3].Email
+	Tag  string // algorithm of the field
+	Err  error
+}
+
+func (e *FieldError) Error() string {
+	return e.Path + " (" + e.Tag + "): " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// Cause returns the underlying error for errors.Cause
+func (e *FieldError) Cause() error {
+	return e.Err
+}
+
+// RecordError records the failure of a record of a Pipeline
+type RecordError struct {
+	Index  int         // position of the record in the input stream
+	Record interface{} // the record as it was left by the failed call
+	Err    error
+}
+
+func (e *RecordError) Error() string {
+	return "record " + strconv.Itoa(e.Index) + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+// Cause returns the underlying error for errors.Cause
+func (e *RecordError) Cause() error {
+	return e.Err
+}
+
+// sentinelError keeps the message of an error while making it match one of
+// the sentinel errors above.
+type sentinelError struct {
+	sentinel error
+	msg      string
+	cause    error
+}
+
+// newError returns an error with msg that matches sentinel.
+func newError(sentinel error, msg string) error {
+	return &sentinelError{sentinel: sentinel, msg: msg}
+}
+
+// wrapError annotates cause with msg like errors.Wrap, and makes the result
+// match sentinel.
+func wrapError(sentinel error, cause error, msg string) error {
+	return &sentinelError{sentinel: sentinel, msg: msg, cause: cause}
+}
+
+func (e *sentinelError) Error() string {
+	if e.cause == nil {
+		return e.msg
+	}
+	return e.msg + ": " + e.cause.Error()
+}
+
+func (e *sentinelError) Is(target error) bool {
+	return target == e.sentinel
+}
+
+func (e *sentinelError) Unwrap() error {
+	return e.cause
+}
+
+// MultiError lists every failure of an Encrypt or Decrypt call in
+// ContinueOnError mode, in the order the fields were visited
+type MultiError struct {
+	Errors []error
+}
+
+func (e *MultiError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return strconv.Itoa(len(e.Errors)) + " fields failed: " + strings.Join(msgs, "; ")
+}
+
+// Is reports whether any of the errors matches target
+func (e *MultiError) Is(target error) bool {
+	for _, err := range e.Errors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first error that matches target
+func (e *MultiError) As(target interface{}) bool {
+	for _, err := range e.Errors {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrorPolicy decides what happens to a field that failed in ContinueOnError
+// mode. A failed map key always keeps its value.
+type ErrorPolicy int
+
+const (
+	// KeepOnError leaves the failed field as it was
+	KeepOnError ErrorPolicy = iota
+	// ReplaceOnError replaces the failed field with Option.Placeholder
+	ReplaceOnError
+	// ClearOnError sets the failed field to the empty string
+	ClearOnError
+)
@@ -0,0 +1,123 @@
+// Code generated by gocrypt-gen. DO NOT EDIT.
+
+package main
+
+import (
+	"strconv"
+
+	"github.com/firdasafridi/gocrypt"
+)
+
+// EncryptFields encrypts the tagged fields of v without reflection
+func (v *Contact) EncryptFields(opt *gocrypt.Option) error {
+	return v.gocryptFields(gocrypt.NewFieldTransformer(opt.EncryptValue))
+}
+
+// DecryptFields decrypts the tagged fields of v without reflection
+func (v *Contact) DecryptFields(opt *gocrypt.Option) error {
+	return v.gocryptFields(gocrypt.NewFieldTransformer(opt.DecryptValue))
+}
+
+func (v *Contact) gocryptFields(t *gocrypt.FieldTransformer) error {
+	if v == nil || t.Seen(v, 0) {
+		return nil
+	}
+	var (
+		s   string
+		err error
+	)
+	if len(v.Emails) > 0 && !t.Seen(&v.Emails[0], len(v.Emails)) {
+		for i := range v.Emails {
+			if v.Emails[i] == "" {
+				continue
+			}
+			if s, err = t.Transform("aes,omitempty", v.Emails[i]); err != nil {
+				return &gocrypt.FieldError{Path: "Emails[" + strconv.Itoa(i) + "]", Tag: "aes", Err: err}
+			}
+			v.Emails[i] = s
+		}
+	}
+	return nil
+}
+
+// EncryptFields encrypts the tagged fields of v without reflection
+func (v *Data) EncryptFields(opt *gocrypt.Option) error {
+	return v.gocryptFields(gocrypt.NewFieldTransformer(opt.EncryptValue))
+}
+
+// DecryptFields decrypts the tagged fields of v without reflection
+func (v *Data) DecryptFields(opt *gocrypt.Option) error {
+	return v.gocryptFields(gocrypt.NewFieldTransformer(opt.DecryptValue))
+}
+
+func (v *Data) gocryptFields(t *gocrypt.FieldTransformer) error {
+	if v == nil || t.Seen(v, 0) {
+		return nil
+	}
+	if err := v.Profile.gocryptFields(t); err != nil {
+		return gocrypt.NestFieldError("Profile", err)
+	}
+	if err := v.Identity.gocryptFields(t); err != nil {
+		return gocrypt.NestFieldError("Identity", err)
+	}
+	for i := range v.Contacts {
+		if err := v.Contacts[i].gocryptFields(t); err != nil {
+			return gocrypt.NestFieldError("Contacts["+strconv.Itoa(i)+"]", err)
+		}
+	}
+	return nil
+}
+
+// EncryptFields encrypts the tagged fields of v without reflection
+func (v *Identity) EncryptFields(opt *gocrypt.Option) error {
+	return v.gocryptFields(gocrypt.NewFieldTransformer(opt.EncryptValue))
+}
+
+// DecryptFields decrypts the tagged fields of v without reflection
+func (v *Identity) DecryptFields(opt *gocrypt.Option) error {
+	return v.gocryptFields(gocrypt.NewFieldTransformer(opt.DecryptValue))
+}
+
+func (v *Identity) gocryptFields(t *gocrypt.FieldTransformer) error {
+	if v == nil || t.Seen(v, 0) {
+		return nil
+	}
+	var (
+		s   string
+		err error
+	)
+	if s, err = t.Transform("aes", v.ID); err != nil {
+		return &gocrypt.FieldError{Path: "ID", Tag: "aes", Err: err}
+	}
+	v.ID = s
+	if s, err = t.Transform("aes", v.LicenseNumber); err != nil {
+		return &gocrypt.FieldError{Path: "LicenseNumber", Tag: "aes", Err: err}
+	}
+	v.LicenseNumber = s
+	return nil
+}
+
+// EncryptFields encrypts the tagged fields of v without reflection
+func (v *Profile) EncryptFields(opt *gocrypt.Option) error {
+	return v.gocryptFields(gocrypt.NewFieldTransformer(opt.EncryptValue))
+}
+
+// DecryptFields decrypts the tagged fields of v without reflection
+func (v *Profile) DecryptFields(opt *gocrypt.Option) error {
+	return v.gocryptFields(gocrypt.NewFieldTransformer(opt.DecryptValue))
+}
+
+func (v *Profile) gocryptFields(t *gocrypt.FieldTransformer) error {
+	if v == nil || t.Seen(v, 0) {
+		return nil
+	}
+	var (
+		s   string
+		err error
+	)
+	if s, err = t.Transform("aes", v.PhoneNumber); err != nil {
+		return &gocrypt.FieldError{Path: "PhoneNumber", Tag: "aes", Err: err}
+	}
+	v.PhoneNumber = s
+	return nil
+}
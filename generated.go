@@ -0,0 +1,103 @@
+package gocrypt
+
+import (
+	"context"
+	"sync"
+)
+
+// FieldsEncrypter is implemented by types with methods generated by
+// cmd/gocrypt-gen. Encrypt and Decrypt call them instead of walking the
+// value with reflection, unless the option or the call asks for something
+// they don't cover: ContinueOnError, Atomic, Strict, MaxDepth, registered
+// rules, another TagName or call options. EncryptContext and DecryptContext
+// always walk with reflection, so the context reaches the options.
+type FieldsEncrypter interface {
+	EncryptFields(opt *Option) error
+	DecryptFields(opt *Option) error
+}
+
+// tagCache caches the tags parsed by EncryptValue and DecryptValue
+var tagCache sync.Map // map[string]tagOptions
+
+// EncryptValue encrypts a single value as a field tagged with tag would be,
+// e.g. opt.EncryptValue("aes,enc=base64", email). It is used by generated
+// code.
+func (opt *Option) EncryptValue(tag string, value string) (string, error) {
+	return opt.encrypt(context.Background(), cachedTag(tag), value)
+}
+
+// DecryptValue decrypts a single value, see EncryptValue
+func (opt *Option) DecryptValue(tag string, value string) (string, error) {
+	return opt.decrypt(context.Background(), cachedTag(tag), value)
+}
+
+// FieldTransformer transforms the fields of a single call for generated code.
+// It remembers the structs and slices it has been through, so that shared
+// ones are transformed once per call, as with reflection.
+type FieldTransformer struct {
+	transform func(tag, value string) (string, error)
+	visited   map[generatedVisit]struct{}
+}
+
+// generatedVisit identifies a struct by its pointer, or the elements of a
+// slice by the pointer to the first one and their number
+type generatedVisit struct {
+	ptr interface{}
+	len int
+}
+
+// NewFieldTransformer returns a FieldTransformer applying transform, which is
+// opt.EncryptValue or opt.DecryptValue. It is used by generated code.
+func NewFieldTransformer(transform func(tag, value string) (string, error)) *FieldTransformer {
+	return &FieldTransformer{transform: transform}
+}
+
+// Transform transforms value as a field tagged with tag would be
+func (t *FieldTransformer) Transform(tag, value string) (string, error) {
+	return t.transform(tag, value)
+}
+
+// Seen marks ptr, a pointer to a struct or to the first of the n elements of
+// a slice, as visited and reports whether it already was.
+func (t *FieldTransformer) Seen(ptr interface{}, n int) bool {
+	key := generatedVisit{ptr: ptr, len: n}
+	if _, ok := t.visited[key]; ok {
+		return true
+	}
+	if t.visited == nil {
+		t.visited = make(map[generatedVisit]struct{})
+	}
+	t.visited[key] = struct{}{}
+	return false
+}
+
+// NestFieldError prefixes the path of a *FieldError with the path of the
+// field holding it, e.g. Items[3] and Email make Items[3].Email. Other errors
+// are returned as they are. It is used by generated code.
+func NestFieldError(prefix string, err error) error {
+	fieldErr, ok := err.(*FieldError)
+	if !ok {
+		return err
+	}
+	path := prefix + "." + fieldErr.Path
+	if fieldErr.Path == "" || fieldErr.Path[0] == '[' {
+		path = prefix + fieldErr.Path
+	}
+	return &FieldError{Path: path, Tag: fieldErr.Tag, Err: fieldErr.Err}
+}
+
+// useGenerated reports whether a call can use generated methods: they cover
+// the tags of a type, but not the options that change how it is walked.
+func (opt *Option) useGenerated(opts []CallOption) bool {
+	return len(opts) == 0 && !opt.ContinueOnError && !opt.Atomic && !opt.Strict &&
+		opt.MaxDepth == 0 && opt.rules == nil && (opt.TagName == "" || opt.TagName == GOCRYPT)
+}
+
+func cachedTag(tag string) tagOptions {
+	if cached, ok := tagCache.Load(tag); ok {
+		return cached.(tagOptions)
+	}
+	opts, _ := parseTag(tag)
+	tagCache.Store(tag, opts)
+	return opts
+}
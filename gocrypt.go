@@ -1,11 +1,18 @@
 package gocrypt
 
-import "github.com/pkg/errors"
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
 
 // GocryptInterface is facing the format gocrypt option library
 type GocryptInterface interface {
-	Encrypt(interface{}) error
-	Decrypt(interface{}) error
+	Encrypt(interface{}, ...CallOption) error
+	Decrypt(interface{}, ...CallOption) error
 }
 
 // GocryptOption is facing the format encryption and decryption format
@@ -20,9 +27,46 @@ type Option struct {
 	AES256GCMOpt GocryptOption
 	DESOpt       GocryptOption
 	RC4Opt       GocryptOption
-	Custom       map[string]GocryptOption
-	Prefix       string
-	Postfix      string
+	// Custom maps a tag algorithm name to its option. An entry named after
+	// a built-in algorithm (aes, aes256gcm, des, rc4) overrides it.
+	Custom map[string]GocryptOption
+	// Prefix and Postfix mark a ciphertext, e.g. "ENC(" and ")". When either
+	// is set, Encrypt wraps every ciphertext in them and skips values that are
+	// already wrapped, and Decrypt strips them and skips unwrapped values.
+	Prefix  string
+	Postfix string
+	// MaxDepth limits how deep nested structs are walked, 0 means unlimited.
+	// Cycles are detected regardless, so it only guards very deep graphs.
+	MaxDepth int
+	// ContinueOnError transforms every field even when some of them fail, and
+	// returns all the failures in a *MultiError.
+	ContinueOnError bool
+	// OnError picks the ErrorPolicy of each failed field in ContinueOnError
+	// mode, nil keeps every failed field as it was.
+	OnError func(*FieldError) ErrorPolicy
+	// Placeholder is the value ReplaceOnError writes to a failed field
+	Placeholder string
+	// Atomic computes every new value before writing any of them, so a call
+	// that fails leaves the value untouched. In ContinueOnError mode all the
+	// failures are still reported, but nothing is written.
+	Atomic bool
+	// Strict turns silent mistakes into errors: a tag naming an unknown
+	// algorithm, a tag on a field that can't be transformed, and a struct
+	// passed by value. Statically reachable types are checked before
+	// anything is written.
+	Strict bool
+	// DefaultAlgorithm is used by fields tagged with an empty algorithm or
+	// "default", e.g. `gocrypt:""`. It falls back to aes when empty.
+	DefaultAlgorithm string
+	// TagName is the struct tag key read by Encrypt and Decrypt, GOCRYPT when
+	// empty. Options with different tag names let one struct carry
+	// independent schemes, e.g. `gocrypt:"aes" wire:"rc4"`.
+	TagName string
+	// Keys maps a key id to the option used by fields tagged keyid=ID, e.g.
+	// `gocrypt:"aes,keyid=pii-2024"`. It replaces the option of the algorithm.
+	Keys map[string]GocryptOption
+
+	rules *registry // added by Register
 }
 
 // New create and initialize new option for struct field encryption.
@@ -32,78 +76,214 @@ func New(opt *Option) *Option {
 	return opt
 }
 
-// Encrypt is function to set struct field encrypted
-func (opt *Option) Encrypt(structVal interface{}) error {
-	return read(structVal, opt.encrypt)
+// Encrypt is function to set struct field encrypted. opts restrict the
+// fields, see Only and Except. Types implementing FieldsEncrypter are
+// encrypted by their generated methods when the call allows it.
+func (opt *Option) Encrypt(structVal interface{}, opts ...CallOption) error {
+	if fields, ok := structVal.(FieldsEncrypter); ok && opt.useGenerated(opts) {
+		return fields.EncryptFields(opt)
+	}
+	return opt.transform(context.Background(), structVal, false, opts)
 }
 
-// Decrypt is function to set struct field decrypted
-func (opt *Option) Decrypt(structVal interface{}) error {
-	return read(structVal, opt.decrypt)
+// Decrypt is function to set struct field decrypted, see Encrypt
+func (opt *Option) Decrypt(structVal interface{}, opts ...CallOption) error {
+	if fields, ok := structVal.(FieldsEncrypter); ok && opt.useGenerated(opts) {
+		return fields.DecryptFields(opt)
+	}
+	return opt.transform(context.Background(), structVal, true, opts)
 }
 
-func (opt *Option) encrypt(algo string, plainText string) (string, error) {
-	// Convert to []byte only once
-	plainByte := []byte(plainText)
+// EncryptContext is Encrypt with a context. The context reaches options
+// implementing ContextOption, and the walk stops with the context's error
+// once it is done.
+func (opt *Option) EncryptContext(ctx context.Context, structVal interface{}, opts ...CallOption) error {
+	return opt.transform(ctx, structVal, false, opts)
+}
 
-	switch algo {
-	case "aes":
-		if opt.AESOpt == nil {
-			return "", errors.New("AESOpt is not initialized")
-		}
-		return opt.AESOpt.Encrypt(plainByte)
-	case "aes256gcm":
-		if opt.AES256GCMOpt == nil {
-			return "", errors.New("AES256GCMOpt is not initialized")
-		}
-		return opt.AES256GCMOpt.Encrypt(plainByte)
-	case "des":
-		if opt.DESOpt == nil {
-			return "", errors.New("DESOpt is not initialized")
-		}
-		return opt.DESOpt.Encrypt(plainByte)
-	case "rc4":
-		if opt.RC4Opt == nil {
-			return "", errors.New("RC4Opt is not initialized")
-		}
-		return opt.RC4Opt.Encrypt(plainByte)
-	default:
-		if opt.AESOpt == nil {
-			return "", errors.New("AESOpt is not initialized")
-		}
-		return opt.AESOpt.Encrypt(plainByte)
+// DecryptContext is Decrypt with a context, see EncryptContext
+func (opt *Option) DecryptContext(ctx context.Context, structVal interface{}, opts ...CallOption) error {
+	return opt.transform(ctx, structVal, true, opts)
+}
+
+func (opt *Option) transform(ctx context.Context, structVal interface{}, decrypting bool, opts []CallOption) error {
+	w := opt.newWalker(ctx, decrypting)
+	if err := w.applyCallOptions(structVal, opts); err != nil {
+		return err
+	}
+	return w.read(structVal)
+}
+
+// EncryptCopy returns an encrypted deep copy of structVal and leaves
+// structVal untouched. The copy has the same type as structVal, which may be
+// a pointer, a struct value, a slice or a map.
+func (opt *Option) EncryptCopy(structVal interface{}, opts ...CallOption) (interface{}, error) {
+	return opt.transformCopy(structVal, false, opts)
+}
+
+// DecryptCopy returns a decrypted deep copy of structVal and leaves
+// structVal untouched, see EncryptCopy.
+func (opt *Option) DecryptCopy(structVal interface{}, opts ...CallOption) (interface{}, error) {
+	return opt.transformCopy(structVal, true, opts)
+}
+
+func (opt *Option) transformCopy(structVal interface{}, decrypting bool, opts []CallOption) (interface{}, error) {
+	if structVal == nil {
+		return nil, nil
+	}
+
+	// Walk the copy through a pointer so a struct value is addressable
+	dst := reflect.New(reflect.TypeOf(structVal))
+	dst.Elem().Set(newCopier().copyValue(reflect.ValueOf(structVal)))
+	if err := opt.transform(context.Background(), dst.Interface(), decrypting, opts); err != nil {
+		return nil, err
+	}
+	return dst.Elem().Interface(), nil
+}
+
+func (opt *Option) newWalker(ctx context.Context, decrypting bool) *walker {
+	w := newWalker(func(tag tagOptions, plainText string) (string, error) {
+		return opt.encrypt(ctx, tag, plainText)
+	})
+	if decrypting {
+		w = newWalker(func(tag tagOptions, cipherText string) (string, error) {
+			return opt.decrypt(ctx, tag, cipherText)
+		})
+		w.decrypting = true
+	}
+	w.ctx = ctx
+	if opt.TagName != "" {
+		w.tagName = opt.TagName
 	}
+	w.maxDepth = opt.MaxDepth
+	w.continueOnError = opt.ContinueOnError
+	w.onError = opt.OnError
+	w.placeholder = opt.Placeholder
+	w.atomic = opt.Atomic
+	w.strict = opt.Strict
+	w.checkTag = opt.checkTag
+	w.rules = opt.rules
+	if opt.hasMarkers() {
+		w.marked = opt.marked
+	}
+	return w
+}
+
+func (opt *Option) encrypt(ctx context.Context, tag tagOptions, plainText string) (string, error) {
+	gocryptOpt, err := opt.fieldOption(tag)
+	if err != nil {
+		return "", err
+	}
+	if !opt.hasMarkers() {
+		return encryptString(ctx, gocryptOpt, tag.encoding, plainText)
+	}
+	if opt.marked(plainText) {
+		// already encrypted
+		return plainText, nil
+	}
+	if s, ok := sealerOf(gocryptOpt); ok {
+		// the markers go into the same string as the ciphertext
+		return sealString(s, sealEncoding(s, tag.encoding), opt.Prefix, opt.Postfix, plainText)
+	}
+	cipherText, err := encryptString(ctx, gocryptOpt, tag.encoding, plainText)
+	if err != nil {
+		return "", err
+	}
+	return opt.Prefix + cipherText + opt.Postfix, nil
+}
+
+func (opt *Option) decrypt(ctx context.Context, tag tagOptions, cipherText string) (string, error) {
+	gocryptOpt, err := opt.fieldOption(tag)
+	if err != nil {
+		return "", err
+	}
+	if !opt.hasMarkers() {
+		return decryptString(ctx, gocryptOpt, tag.encoding, cipherText)
+	}
+	if !opt.marked(cipherText) {
+		// already decrypted
+		return cipherText, nil
+	}
+	cipherText = cipherText[len(opt.Prefix) : len(cipherText)-len(opt.Postfix)]
+	return decryptString(ctx, gocryptOpt, tag.encoding, cipherText)
+}
+
+func (opt *Option) hasMarkers() bool {
+	return opt.Prefix != "" || opt.Postfix != ""
+}
+
+// marked reports whether value is wrapped in Prefix and Postfix.
+func (opt *Option) marked(value string) bool {
+	return len(value) >= len(opt.Prefix)+len(opt.Postfix) &&
+		strings.HasPrefix(value, opt.Prefix) &&
+		strings.HasSuffix(value, opt.Postfix)
+}
+
+// checkTag reports in strict mode a tag whose algorithm or key id is unknown.
+// An algorithm that is known but not configured is only reported when used.
+func (opt *Option) checkTag(tag tagOptions) error {
+	if _, err := opt.option(tag.algo); errors.Is(err, ErrUnknownAlgorithm) {
+		return err
+	}
+	if _, ok := opt.Keys[tag.keyID]; tag.keyID != "" && !ok {
+		return newError(ErrNotInitialized, "unknown key id "+strconv.Quote(tag.keyID))
+	}
+	return nil
+}
+
+// fieldOption returns the option of a field: the named key of its key id, or
+// the option of its algorithm.
+func (opt *Option) fieldOption(tag tagOptions) (GocryptOption, error) {
+	if tag.keyID == "" {
+		return opt.option(tag.algo)
+	}
+	key := opt.Keys[tag.keyID]
+	if key == nil {
+		return nil, newError(ErrNotInitialized, "Keys["+strconv.Quote(tag.keyID)+"] is not initialized")
+	}
+	return key, nil
 }
 
-func (opt *Option) decrypt(algo string, cipherText string) (string, error) {
-	// Convert to []byte only once
-	cipherByte := []byte(cipherText)
+// option returns the GocryptOption registered for the tag algorithm.
+// Custom entries take precedence over the built-in algorithms, so a custom
+// "aes" replaces AESOpt.
+func (opt *Option) option(algo string) (GocryptOption, error) {
+	if algo == "" || algo == DEFAULT {
+		algo = opt.DefaultAlgorithm
+		if algo == "" || algo == DEFAULT {
+			algo = AES
+		}
+	}
+
+	if custom, ok := opt.Custom[algo]; ok {
+		if custom == nil {
+			return nil, newError(ErrNotInitialized, "Custom["+strconv.Quote(algo)+"] is not initialized")
+		}
+		return custom, nil
+	}
 
 	switch algo {
-	case "aes":
+	case AES:
 		if opt.AESOpt == nil {
-			return "", errors.New("AESOpt is not initialized")
+			return nil, newError(ErrNotInitialized, "AESOpt is not initialized")
 		}
-		return opt.AESOpt.Decrypt(cipherByte)
-	case "aes256gcm":
+		return opt.AESOpt, nil
+	case AES256GCM:
 		if opt.AES256GCMOpt == nil {
-			return "", errors.New("AES256GCMOpt is not initialized")
+			return nil, newError(ErrNotInitialized, "AES256GCMOpt is not initialized")
 		}
-		return opt.AES256GCMOpt.Decrypt(cipherByte)
-	case "des":
+		return opt.AES256GCMOpt, nil
+	case DES:
 		if opt.DESOpt == nil {
-			return "", errors.New("DESOpt is not initialized")
+			return nil, newError(ErrNotInitialized, "DESOpt is not initialized")
 		}
-		return opt.DESOpt.Decrypt(cipherByte)
-	case "rc4":
+		return opt.DESOpt, nil
+	case RC4:
 		if opt.RC4Opt == nil {
-			return "", errors.New("RC4Opt is not initialized")
+			return nil, newError(ErrNotInitialized, "RC4Opt is not initialized")
 		}
-		return opt.RC4Opt.Decrypt(cipherByte)
+		return opt.RC4Opt, nil
 	default:
-		if opt.AESOpt == nil {
-			return "", errors.New("AESOpt is not initialized")
-		}
-		return opt.AESOpt.Decrypt(cipherByte)
+		return nil, newError(ErrUnknownAlgorithm, "unknown algorithm "+strconv.Quote(algo))
 	}
 }
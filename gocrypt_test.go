@@ -0,0 +1,1360 @@
+package gocrypt
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	testAESKey = "fa89277fb1e1c344709190deeac4465c2b28396423c8534a90c86322d0ec9dcf"
+	testDESKey = "123456781234567812345678"
+	testRC4Key = "adfasd123123ksdfsd"
+)
+
+// upperOpt is a reversible toy option used to observe custom routing.
+type upperOpt struct{}
+
+func (upperOpt) Encrypt(plainText []byte) (string, error) {
+	return "up:" + strings.ToUpper(string(plainText)), nil
+}
+
+func (upperOpt) Decrypt(cipherText []byte) (string, error) {
+	return strings.ToLower(strings.TrimPrefix(string(cipherText), "up:")), nil
+}
+
+func newTestOption(t testing.TB) *Option {
+	aesOpt, err := NewAESOpt(testAESKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aes256GCMOpt, err := NewAES256GCMOpt(testAESKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desOpt, err := NewDESOpt(testDESKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc4Opt, err := NewRC4Opt(testRC4Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(&Option{
+		AESOpt:       aesOpt,
+		AES256GCMOpt: aes256GCMOpt,
+		DESOpt:       desOpt,
+		RC4Opt:       rc4Opt,
+	})
+}
+
+type customStruct struct {
+	Name  string `gocrypt:"upper"`
+	Email string `gocrypt:"aes"`
+}
+
+func TestOptionCustom(t *testing.T) {
+	opt := newTestOption(t)
+	opt.Custom = map[string]GocryptOption{"upper": upperOpt{}}
+
+	data := &customStruct{Name: "batman", Email: "bruce@wayne.com"}
+	if err := opt.Encrypt(data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Name != "up:BATMAN" {
+		t.Errorf("Name = %q, want custom ciphertext", data.Name)
+	}
+	if err := opt.Decrypt(data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Name != "batman" || data.Email != "bruce@wayne.com" {
+		t.Errorf("round trip = %+v", data)
+	}
+}
+
+func TestOptionCustomOverridesBuiltin(t *testing.T) {
+	opt := newTestOption(t)
+	opt.Custom = map[string]GocryptOption{AES: upperOpt{}, "upper": upperOpt{}}
+
+	data := &customStruct{Email: "bruce"}
+	if err := opt.Encrypt(data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Email != "up:BRUCE" {
+		t.Errorf("Email = %q, want custom aes ciphertext", data.Email)
+	}
+}
+
+func TestOptionUnknownAlgorithm(t *testing.T) {
+	opt := newTestOption(t)
+
+	data := &customStruct{Name: "batman"}
+	err := opt.Encrypt(data)
+	if err == nil || !strings.Contains(err.Error(), `unknown algorithm "upper"`) {
+		t.Fatalf("Encrypt error = %v, want unknown algorithm", err)
+	}
+	if data.Name != "batman" {
+		t.Errorf("Name = %q, want untouched", data.Name)
+	}
+}
+
+type markedStruct struct {
+	Phone string `gocrypt:"aes"`
+	Email string `gocrypt:"des"`
+}
+
+func TestOptionMarkersIdempotent(t *testing.T) {
+	opt := newTestOption(t)
+	opt.Prefix, opt.Postfix = "ENC(", ")"
+
+	data := &markedStruct{Phone: "+62123123123", Email: "bruce@wayne.com"}
+	if err := opt.Decrypt(data); err != nil {
+		t.Fatalf("Decrypt on plaintext: %v", err)
+	}
+	if err := opt.Encrypt(data); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(data.Phone, "ENC(") || !strings.HasSuffix(data.Phone, ")") {
+		t.Fatalf("Phone = %q, want wrapped ciphertext", data.Phone)
+	}
+	encrypted := *data
+	if err := opt.Encrypt(data); err != nil {
+		t.Fatal(err)
+	}
+	if *data != encrypted {
+		t.Fatalf("second Encrypt changed %+v to %+v", encrypted, *data)
+	}
+	for i := 0; i < 2; i++ {
+		if err := opt.Decrypt(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if data.Phone != "+62123123123" || data.Email != "bruce@wayne.com" {
+		t.Errorf("round trip = %+v", data)
+	}
+}
+
+type identityStruct struct {
+	Identity struct {
+		LicenseNumber string `gocrypt:"aes"`
+	}
+}
+
+func TestOptionSentinelErrors(t *testing.T) {
+	opt := newTestOption(t)
+	aesOpt, err := NewAESOpt(strings.Repeat("0", 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongKey := New(&Option{AESOpt: aesOpt})
+
+	encrypted := &identityStruct{}
+	encrypted.Identity.LicenseNumber = "JSKI-123-456"
+	if err := opt.Encrypt(encrypted); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		opt      *Option
+		value    string
+		sentinel error
+	}{
+		{name: "not initialized", opt: New(&Option{}), value: "plain", sentinel: ErrNotInitialized},
+		{name: "malformed", opt: opt, value: "not hex", sentinel: ErrMalformedCiphertext},
+		{name: "too short", opt: opt, value: "abcd", sentinel: ErrMalformedCiphertext},
+		{name: "wrong key", opt: wrongKey, value: encrypted.Identity.LicenseNumber, sentinel: ErrAuthenticationFailed},
+	}
+	for _, tt := range tests {
+		data := &identityStruct{}
+		data.Identity.LicenseNumber = tt.value
+		err := tt.opt.Decrypt(data)
+		if !errors.Is(err, tt.sentinel) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.sentinel)
+		}
+		var fieldErr *FieldError
+		if !errors.As(err, &fieldErr) || fieldErr.Path != "Identity.LicenseNumber" || fieldErr.Tag != AES {
+			t.Errorf("%s: err = %#v, want FieldError for Identity.LicenseNumber", tt.name, err)
+		}
+	}
+}
+
+func TestOptionSentinelErrorsBuiltin(t *testing.T) {
+	opt := newTestOption(t)
+	for _, algo := range []string{AES, AES256GCM, DES, RC4} {
+		gocryptOpt, err := opt.option(algo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := gocryptOpt.Decrypt([]byte("%%%")); !errors.Is(err, ErrMalformedCiphertext) {
+			t.Errorf("%s: err = %v, want ErrMalformedCiphertext", algo, err)
+		}
+	}
+
+	if _, err := (&DESOpt{}).Encrypt([]byte("x")); !errors.Is(err, ErrNotInitialized) {
+		t.Errorf("DESOpt: err = %v, want ErrNotInitialized", err)
+	}
+	desOpt := opt.DESOpt.(*DESOpt)
+	if _, err := desOpt.Decrypt([]byte("AAAAAAAAAAAAAAAA")); !errors.Is(err, ErrMalformedCiphertext) {
+		t.Errorf("DESOpt: err = %v, want ErrMalformedCiphertext for partial block", err)
+	}
+	if err := opt.Encrypt(&customStruct{Name: "x"}); !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Errorf("err = %v, want ErrUnknownAlgorithm", err)
+	}
+}
+
+func TestOptionContinueOnError(t *testing.T) {
+	opt := newTestOption(t)
+	good := &markedStruct{Phone: "+62123123123", Email: "bruce@wayne.com"}
+	if err := opt.Encrypt(good); err != nil {
+		t.Fatal(err)
+	}
+
+	opt.ContinueOnError = true
+	opt.Placeholder = "<redacted>"
+	opt.OnError = func(fieldErr *FieldError) ErrorPolicy {
+		if strings.HasSuffix(fieldErr.Path, "Phone") {
+			return ReplaceOnError
+		}
+		return ClearOnError
+	}
+	rows := []markedStruct{
+		{Phone: "corrupted", Email: good.Email},
+		*good,
+		{Phone: good.Phone, Email: "corrupted"},
+	}
+	err := opt.Decrypt(rows)
+
+	var multiErr *MultiError
+	if !errors.As(err, &multiErr) || len(multiErr.Errors) != 2 {
+		t.Fatalf("err = %v, want 2 field errors", err)
+	}
+	if !errors.Is(err, ErrMalformedCiphertext) {
+		t.Errorf("err = %v, want ErrMalformedCiphertext", err)
+	}
+	var fieldErr *FieldError
+	if !errors.As(multiErr.Errors[1], &fieldErr) || fieldErr.Path != "[2].Email" {
+		t.Errorf("Errors[1] = %v, want [2].Email", multiErr.Errors[1])
+	}
+	want := []markedStruct{
+		{Phone: "<redacted>", Email: "bruce@wayne.com"},
+		{Phone: "+62123123123", Email: "bruce@wayne.com"},
+		{Phone: "+62123123123", Email: ""},
+	}
+	for i := range want {
+		if rows[i] != want[i] {
+			t.Errorf("rows[%d] = %+v, want %+v", i, rows[i], want[i])
+		}
+	}
+}
+
+type keysStruct struct {
+	Labels map[string]string `gocrypt:"aes,keys"`
+}
+
+func TestOptionContinueOnErrorMapKeys(t *testing.T) {
+	opt := newTestOption(t)
+	opt.ContinueOnError = true
+	opt.Placeholder = "<bad>"
+	for _, policy := range []ErrorPolicy{ReplaceOnError, ClearOnError} {
+		opt.OnError = func(*FieldError) ErrorPolicy { return policy }
+		data := &keysStruct{Labels: map[string]string{"notcipher1": "a", "notcipher2": "b"}}
+		err := opt.Decrypt(data)
+
+		var multiErr *MultiError
+		if !errors.As(err, &multiErr) || len(multiErr.Errors) < 2 {
+			t.Fatalf("err = %v, want the errors of both keys", err)
+		}
+		// failed keys keep their value, the policy applies to the values
+		_, ok1 := data.Labels["notcipher1"]
+		_, ok2 := data.Labels["notcipher2"]
+		if len(data.Labels) != 2 || !ok1 || !ok2 {
+			t.Errorf("policy %d: Labels = %v, want both keys kept", policy, data.Labels)
+		}
+	}
+}
+
+type atomicStruct struct {
+	F1    string            `gocrypt:"aes"`
+	F2    string            `gocrypt:"des"`
+	F3    []string          `gocrypt:"rc4"`
+	F4    map[string]string `gocrypt:"aes"`
+	F5    string            `gocrypt:"failing"`
+	Inner map[string]Contact
+}
+
+// failingOpt fails on every value except "ok".
+type failingOpt struct{}
+
+func (failingOpt) Encrypt(plainText []byte) (string, error) {
+	if string(plainText) != "ok" {
+		return "", errors.New("failingOpt")
+	}
+	return "ok", nil
+}
+
+func (failingOpt) Decrypt(cipherText []byte) (string, error) {
+	return failingOpt{}.Encrypt(cipherText)
+}
+
+func TestOptionAtomic(t *testing.T) {
+	opt := newTestOption(t)
+	opt.Custom = map[string]GocryptOption{"failing": failingOpt{}}
+	opt.Atomic = true
+
+	newData := func(f5 string) *atomicStruct {
+		return &atomicStruct{
+			F1:    "one",
+			F2:    "two",
+			F3:    []string{"three"},
+			F4:    map[string]string{"four": "four"},
+			F5:    f5,
+			Inner: map[string]Contact{"five": {Email: "five"}},
+		}
+	}
+
+	data := newData("boom")
+	if err := opt.Encrypt(data); err == nil {
+		t.Fatal("Encrypt succeeded, want failingOpt error")
+	}
+	if !reflect.DeepEqual(data, newData("boom")) {
+		t.Errorf("failed Encrypt wrote %+v", data)
+	}
+
+	opt.ContinueOnError = true
+	opt.OnError = func(*FieldError) ErrorPolicy { return ClearOnError }
+	if err := opt.Encrypt(data); err == nil {
+		t.Fatal("Encrypt succeeded, want failingOpt error")
+	}
+	if !reflect.DeepEqual(data, newData("boom")) {
+		t.Errorf("failed Encrypt wrote %+v", data)
+	}
+
+	data = newData("ok")
+	if err := opt.Encrypt(data); err != nil {
+		t.Fatal(err)
+	}
+	if data.F1 == "one" || data.F3[0] == "three" || data.F4["four"] == "four" || data.Inner["five"].Email == "five" {
+		t.Errorf("successful Encrypt didn't commit: %+v", data)
+	}
+	if err := opt.Decrypt(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(data, newData("ok")) {
+		t.Errorf("round trip = %+v", data)
+	}
+}
+
+type copyStruct struct {
+	Profile  *markedStruct
+	Contacts []Contact
+	ByName   map[string]*Contact
+	Self     *copyStruct
+	private  *Contact
+}
+
+func TestOptionEncryptCopy(t *testing.T) {
+	opt := newTestOption(t)
+	private := &Contact{Email: "private"}
+	original := &copyStruct{
+		Profile:  &markedStruct{Phone: "+62123123123", Email: "bruce@wayne.com"},
+		Contacts: []Contact{{Email: "alfred@wayne.com"}},
+		ByName:   map[string]*Contact{"robin": {Email: "robin@wayne.com"}},
+		private:  private,
+	}
+	original.Self = original
+	snapshot := *original.Profile
+
+	encrypted, err := opt.EncryptCopy(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encCopy := encrypted.(*copyStruct)
+	if *original.Profile != snapshot || original.Contacts[0].Email != "alfred@wayne.com" ||
+		original.ByName["robin"].Email != "robin@wayne.com" {
+		t.Fatalf("EncryptCopy modified the original: %+v", original)
+	}
+	if encCopy == original || encCopy.Self != encCopy {
+		t.Errorf("copy doesn't keep its own cycle")
+	}
+	if encCopy.Profile.Phone == snapshot.Phone || encCopy.ByName["robin"].Email == "robin@wayne.com" {
+		t.Errorf("copy is not encrypted: %+v", encCopy)
+	}
+	if encCopy.private != private {
+		t.Errorf("unexported field is not shared")
+	}
+
+	decrypted, err := opt.DecryptCopy(encCopy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decCopy := decrypted.(*copyStruct); *decCopy.Profile != snapshot || decCopy.Contacts[0].Email != "alfred@wayne.com" {
+		t.Errorf("DecryptCopy = %+v", decCopy)
+	}
+}
+
+type copyAudit struct {
+	Actor   string `gocrypt:"aes"`
+	Contact *Contact
+}
+
+type copyEmbedded struct {
+	*copyAudit
+	embeddedAudit
+}
+
+func TestOptionEncryptCopyEmbedded(t *testing.T) {
+	opt := newTestOption(t)
+	original := &copyEmbedded{
+		copyAudit:     &copyAudit{Actor: "alfred", Contact: &Contact{Email: "alfred@wayne.com"}},
+		embeddedAudit: embeddedAudit{Actor: "lucius"},
+	}
+
+	encrypted, err := opt.EncryptCopy(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// gocrypt writes through unexported embedded structs, so they are copied too
+	if original.copyAudit.Actor != "alfred" || original.copyAudit.Contact.Email != "alfred@wayne.com" ||
+		original.embeddedAudit.Actor != "lucius" {
+		t.Fatalf("EncryptCopy modified the original: %+v, %+v", *original.copyAudit, original.embeddedAudit)
+	}
+	encCopy := encrypted.(*copyEmbedded)
+	if encCopy.copyAudit.Actor == "alfred" || encCopy.copyAudit.Contact.Email == "alfred@wayne.com" ||
+		encCopy.embeddedAudit.Actor == "lucius" {
+		t.Errorf("copy is not encrypted: %+v, %+v", *encCopy.copyAudit, encCopy.embeddedAudit)
+	}
+}
+
+func TestOptionEncryptCopyValues(t *testing.T) {
+	opt := newTestOption(t)
+
+	value := markedStruct{Phone: "+62", Email: "a@b.c"}
+	encrypted, err := opt.EncryptCopy(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encValue := encrypted.(markedStruct); encValue.Phone == "+62" || value.Phone != "+62" {
+		t.Errorf("EncryptCopy(value) = %+v, original %+v", encValue, value)
+	}
+
+	byName := map[string]markedStruct{"a": value}
+	encrypted, err = opt.EncryptCopy(byName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encMap := encrypted.(map[string]markedStruct); encMap["a"].Phone == "+62" || byName["a"].Phone != "+62" {
+		t.Errorf("EncryptCopy(map) = %+v, original %+v", encMap, byName)
+	}
+}
+
+type typoStruct struct {
+	Name  string `gocrypt:"aes"`
+	Email string `gocrypt:"ase"`
+}
+
+type intTagStruct struct {
+	Name string `gocrypt:"aes"`
+	Age  int    `gocrypt:"aes"`
+}
+
+type unexportedTagStruct struct {
+	secret string `gocrypt:"aes"`
+}
+
+type strictParent struct {
+	Name     string `gocrypt:"aes"`
+	Children []*intTagStruct
+}
+
+func TestOptionStrict(t *testing.T) {
+	opt := newTestOption(t)
+	opt.Strict = true
+
+	tests := []struct {
+		name     string
+		value    interface{}
+		sentinel error
+		msg      string
+	}{
+		{name: "typo", value: &typoStruct{Name: "a"}, sentinel: ErrUnknownAlgorithm, msg: `gocrypt.typoStruct.Email: unknown algorithm "ase"`},
+		{name: "int", value: &intTagStruct{Name: "a"}, sentinel: ErrUnsupportedType, msg: "gocrypt.intTagStruct.Age: tag on unsupported type int"},
+		{name: "unexported", value: &unexportedTagStruct{}, sentinel: ErrUnsupportedType, msg: "gocrypt.unexportedTagStruct.secret: tag on unexported field"},
+		{name: "by value", value: markedStruct{}, sentinel: ErrNotAddressable, msg: "gocrypt.markedStruct is passed by value"},
+		{name: "nested", value: &strictParent{Name: "a"}, sentinel: ErrUnsupportedType, msg: "gocrypt.intTagStruct.Age"},
+	}
+	for _, tt := range tests {
+		err := opt.Encrypt(tt.value)
+		if !errors.Is(err, tt.sentinel) || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%s: err = %v, want %v containing %q", tt.name, err, tt.sentinel, tt.msg)
+		}
+	}
+
+	// nothing is written before the nested type is rejected
+	parent := &strictParent{Name: "a"}
+	_ = opt.Encrypt(parent)
+	if parent.Name != "a" {
+		t.Errorf("Name = %q, want untouched", parent.Name)
+	}
+
+	opt.Strict = false
+	if err := opt.Encrypt(&intTagStruct{Name: "a"}); err != nil {
+		t.Errorf("non-strict Encrypt: %v", err)
+	}
+}
+
+type defaultStruct struct {
+	Bare     string `gocrypt:""`
+	Default  string `gocrypt:"default"`
+	Untagged string
+}
+
+func TestOptionDefaultAlgorithm(t *testing.T) {
+	opt := newTestOption(t)
+	opt.Custom = map[string]GocryptOption{"upper": upperOpt{}}
+	opt.DefaultAlgorithm = "upper"
+
+	data := &defaultStruct{Bare: "a", Default: "b", Untagged: "c"}
+	if err := opt.Encrypt(data); err != nil {
+		t.Fatal(err)
+	}
+	if *data != (defaultStruct{Bare: "up:A", Default: "up:B", Untagged: "c"}) {
+		t.Errorf("Encrypt = %+v", data)
+	}
+
+	opt.DefaultAlgorithm = ""
+	if err := opt.Decrypt(data); !errors.Is(err, ErrMalformedCiphertext) {
+		t.Errorf("err = %v, want aes to reject custom ciphertext", err)
+	}
+}
+
+type twoSchemes struct {
+	Stored string `gocrypt:"upper"`
+	Wire   string `wire:"upper"`
+	Both   string `gocrypt:"upper" wire:"upper"`
+}
+
+func TestOptionTagName(t *testing.T) {
+	storage := New(&Option{Custom: map[string]GocryptOption{"upper": upperOpt{}}})
+	wire := New(&Option{Custom: map[string]GocryptOption{"upper": upperOpt{}}, TagName: "wire"})
+
+	data := &twoSchemes{Stored: "a", Wire: "b", Both: "c"}
+	if err := wire.Encrypt(data); err != nil {
+		t.Fatal(err)
+	}
+	if *data != (twoSchemes{Stored: "a", Wire: "up:B", Both: "up:C"}) {
+		t.Errorf("wire Encrypt = %+v", data)
+	}
+	if err := storage.Encrypt(data); err != nil {
+		t.Fatal(err)
+	}
+	if *data != (twoSchemes{Stored: "up:A", Wire: "up:B", Both: "up:UP:C"}) {
+		t.Errorf("storage Encrypt = %+v", data)
+	}
+}
+
+type modifiersStruct struct {
+	Empty    string   `gocrypt:"aes,omitempty"`
+	Encoded  string   `gocrypt:"aes256gcm,enc=base64"`
+	Rotated  string   `gocrypt:"aes,keyid=pii-2024"`
+	Excluded string   `gocrypt:"-"`
+	Skipped  *Contact `gocrypt:"-"`
+}
+
+func TestOptionTagModifiers(t *testing.T) {
+	opt := newTestOption(t)
+	opt.Keys = map[string]GocryptOption{"pii-2024": upperOpt{}}
+
+	data := &modifiersStruct{
+		Encoded:  "+62123123123",
+		Rotated:  "bruce",
+		Excluded: "plain",
+		Skipped:  &Contact{Email: "plain"},
+	}
+	if err := opt.Encrypt(data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Empty != "" || data.Excluded != "plain" || data.Skipped.Email != "plain" {
+		t.Errorf("Encrypt touched omitted or excluded fields: %+v", data)
+	}
+	if data.Rotated != "up:BRUCE" {
+		t.Errorf("Rotated = %q, want named key ciphertext", data.Rotated)
+	}
+	if _, err := base64.StdEncoding.DecodeString(data.Encoded); err != nil {
+		t.Errorf("Encoded = %q, want base64: %v", data.Encoded, err)
+	}
+
+	if err := opt.Decrypt(data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Encoded != "+62123123123" || data.Rotated != "bruce" {
+		t.Errorf("round trip = %+v", data)
+	}
+
+	opt.Keys = nil
+	if err := opt.Encrypt(data); !errors.Is(err, ErrNotInitialized) {
+		t.Errorf("err = %v, want ErrNotInitialized for a missing key", err)
+	}
+}
+
+type badModifierStruct struct {
+	Name string `gocrypt:"aes,omitempyt"`
+}
+
+func TestOptionStrictTagModifiers(t *testing.T) {
+	opt := newTestOption(t)
+	opt.Strict = true
+
+	err := opt.Encrypt(&badModifierStruct{})
+	if !errors.Is(err, ErrInvalidTag) || !strings.Contains(err.Error(), `badModifierStruct.Name: unknown tag option "omitempyt"`) {
+		t.Errorf("err = %v, want ErrInvalidTag", err)
+	}
+	err = opt.Encrypt(&modifiersStruct{})
+	if !errors.Is(err, ErrNotInitialized) || !strings.Contains(err.Error(), `modifiersStruct.Rotated: unknown key id "pii-2024"`) {
+		t.Errorf("err = %v, want unknown key id", err)
+	}
+}
+
+// testUUID is a TextMarshaler that can't hold ciphertext itself.
+type testUUID [4]byte
+
+func (u testUUID) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(u[:])), nil
+}
+
+func (u *testUUID) UnmarshalText(text []byte) error {
+	_, err := hex.Decode(u[:], text)
+	return err
+}
+
+type scalarStruct struct {
+	BirthDate    time.Time `gocrypt:"aes,into=BirthDateEnc"`
+	BirthDateEnc string
+	Salary       int64 `gocrypt:"des,into=SalaryEnc"`
+	SalaryEnc    string
+	Active       bool `gocrypt:"rc4,into=ActiveEnc"`
+	ActiveEnc    string
+	Score        *float64 `gocrypt:"aes,into=ScoreEnc"`
+	ScoreEnc     string
+	ID           testUUID `gocrypt:"aes256gcm,into=IDEnc"`
+	IDEnc        string
+	Missing      *float64 `gocrypt:"aes,into=MissingEnc"`
+	MissingEnc   string
+}
+
+func TestOptionScalarInto(t *testing.T) {
+	opt := newTestOption(t)
+	score := 98.5
+	birthDate := time.Date(1939, 5, 1, 0, 0, 0, 0, time.UTC)
+	data := &scalarStruct{
+		BirthDate: birthDate,
+		Salary:    -120000,
+		Active:    true,
+		Score:     &score,
+		ID:        testUUID{0xde, 0xad, 0xbe, 0xef},
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := opt.Encrypt(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !data.BirthDate.IsZero() || data.Salary != 0 || data.Active || data.Score != nil || data.ID != (testUUID{}) {
+		t.Errorf("Encrypt left plain values: %+v", data)
+	}
+	if data.BirthDateEnc == "" || data.SalaryEnc == "" || data.ActiveEnc == "" || data.ScoreEnc == "" || data.IDEnc == "" {
+		t.Errorf("Encrypt didn't fill companions: %+v", data)
+	}
+	if data.MissingEnc != "" {
+		t.Errorf("MissingEnc = %q, want nil pointer left alone", data.MissingEnc)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := opt.Decrypt(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !data.BirthDate.Equal(birthDate) || data.Salary != -120000 || !data.Active ||
+		data.Score == nil || *data.Score != score || data.ID != (testUUID{0xde, 0xad, 0xbe, 0xef}) {
+		t.Errorf("round trip = %+v", data)
+	}
+	if data.BirthDateEnc != "" || data.SalaryEnc != "" || data.ScoreEnc != "" {
+		t.Errorf("Decrypt left companions: %+v", data)
+	}
+}
+
+type badIntoStruct struct {
+	Age    int `gocrypt:"aes,into=AgeEnc"`
+	AgeEnc int
+}
+
+func TestOptionScalarIntoStrict(t *testing.T) {
+	opt := newTestOption(t)
+	opt.Strict = true
+	err := opt.Encrypt(&badIntoStruct{Age: 3})
+	if !errors.Is(err, ErrUnsupportedType) || !strings.Contains(err.Error(), "badIntoStruct.Age: into field AgeEnc is not a string or []byte") {
+		t.Errorf("err = %v, want companion error", err)
+	}
+}
+
+type blobMeta struct {
+	Source string            `json:"source"`
+	Tags   map[string]string `json:"tags"`
+}
+
+type blobStruct struct {
+	Avatar   []byte          `gocrypt:"aes"`
+	Extra    json.RawMessage `gocrypt:"aes256gcm"`
+	Empty    json.RawMessage `gocrypt:"aes"`
+	Meta     *blobMeta       `gocrypt:"aes,into=MetaEnc" json:"-"`
+	MetaEnc  []byte          `json:"meta_enc"`
+	Attrs    map[string]int  `gocrypt:"des,into=AttrsEnc" json:"-"`
+	AttrsEnc json.RawMessage `json:"attrs_enc"`
+}
+
+func TestOptionBytesAndBlobs(t *testing.T) {
+	opt := newTestOption(t)
+	data := &blobStruct{
+		Avatar: []byte{0x89, 'P', 'N', 'G', 0},
+		Extra:  json.RawMessage(`{"ssn":"123-45-6789"}`),
+		Meta:   &blobMeta{Source: "import", Tags: map[string]string{"team": "red"}},
+		Attrs:  map[string]int{"age": 42},
+	}
+	want := &blobStruct{
+		Avatar: append([]byte(nil), data.Avatar...),
+		Extra:  append(json.RawMessage(nil), data.Extra...),
+		Empty:  json.RawMessage("null"), // as unmarshaled
+		Meta:   &blobMeta{Source: "import", Tags: map[string]string{"team": "red"}},
+		Attrs:  map[string]int{"age": 42},
+	}
+
+	if err := opt.Encrypt(data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Meta != nil || data.Attrs != nil || len(data.MetaEnc) == 0 || len(data.AttrsEnc) == 0 {
+		t.Errorf("Encrypt didn't replace the subtrees: %+v", data)
+	}
+	// the document stays valid JSON
+	doc, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(doc), "123-45-6789") || strings.Contains(string(doc), "import") {
+		t.Errorf("encrypted document leaks plain text: %s", doc)
+	}
+	if err := json.Unmarshal(doc, data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := opt.Decrypt(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("round trip = %+v, want %+v", data, want)
+	}
+
+	// with markers, a json.RawMessage is skipped like a string once done
+	opt.Prefix, opt.Postfix = "ENC(", ")"
+	for _, plain := range []string{`{"a":1}`, `"hello"`} {
+		marked := &blobStruct{Extra: json.RawMessage(plain)}
+		if err := opt.Decrypt(marked); err != nil || string(marked.Extra) != plain {
+			t.Errorf("Decrypt on plain text %s = %s, %v", plain, marked.Extra, err)
+		}
+		if err := opt.Encrypt(marked); err != nil {
+			t.Fatal(err)
+		}
+		encrypted := string(marked.Extra)
+		if !strings.HasPrefix(encrypted, `"ENC(`) {
+			t.Fatalf("Extra = %s, want a marked JSON string", encrypted)
+		}
+		if err := opt.Encrypt(marked); err != nil || string(marked.Extra) != encrypted {
+			t.Errorf("second Encrypt changed %s to %s, %v", encrypted, marked.Extra, err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := opt.Decrypt(marked); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if string(marked.Extra) != plain {
+			t.Errorf("round trip = %s, want %s", marked.Extra, plain)
+		}
+	}
+}
+
+type untaggedBlobStruct struct {
+	Meta blobMeta `gocrypt:"aes"`
+}
+
+func TestOptionBlobStrict(t *testing.T) {
+	opt := newTestOption(t)
+	opt.Strict = true
+	err := opt.Encrypt(&untaggedBlobStruct{})
+	if !errors.Is(err, ErrUnsupportedType) || !strings.Contains(err.Error(), "needs into=FIELD") {
+		t.Errorf("err = %v, want into hint", err)
+	}
+
+	data := &blobStruct{Extra: json.RawMessage(`{"plain":true}`)}
+	err = opt.Decrypt(data)
+	if !errors.Is(err, ErrMalformedCiphertext) {
+		t.Errorf("err = %v, want ErrMalformedCiphertext for a RawMessage that isn't a JSON string", err)
+	}
+}
+
+type badDiveStruct struct {
+	Home vendorAddress `gocrypt:"nope,dive"`
+}
+
+func TestOptionDiveStrict(t *testing.T) {
+	opt := newTestOption(t)
+	opt.Strict = true
+	err := opt.Encrypt(&badDiveStruct{})
+	if !errors.Is(err, ErrUnknownAlgorithm) || !strings.Contains(err.Error(), "badDiveStruct.Home") {
+		t.Errorf("err = %v, want unknown algorithm on the dive field", err)
+	}
+}
+
+// vendorUser stands for a type we can't annotate
+type vendorUser struct {
+	Email   string
+	Phone   string `gocrypt:"aes"`
+	Address *vendorAddress
+}
+
+type vendorOffice struct {
+	Address vendorAddress
+}
+
+func TestOptionRegister(t *testing.T) {
+	opt := newTestOption(t)
+	err := opt.Register(reflect.TypeOf(vendorUser{}), Rules{
+		"Email":          "aes256gcm",
+		"Phone":          "-",
+		"Address.Street": "des,omitempty",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := &vendorUser{Email: "bruce@wayne.com", Phone: "+621", Address: &vendorAddress{Street: "1007 Mountain Dr", Lines: []string{"manor"}}}
+	if err := opt.Encrypt(data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Email == "bruce@wayne.com" || data.Address.Street == "1007 Mountain Dr" {
+		t.Errorf("registered fields not encrypted: %+v %+v", data, data.Address)
+	}
+	if data.Phone != "+621" || data.Address.Lines[0] != "manor" {
+		t.Errorf("unregistered fields changed: %+v %+v", data, data.Address)
+	}
+	if err := opt.Decrypt(data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Email != "bruce@wayne.com" || data.Address.Street != "1007 Mountain Dr" {
+		t.Errorf("round trip = %+v %+v", data, data.Address)
+	}
+
+	// other options are not affected
+	plain := &vendorUser{Email: "bruce@wayne.com"}
+	if err := newTestOption(t).Encrypt(plain); err != nil || plain.Email != "bruce@wayne.com" {
+		t.Errorf("Email = %q, %v, want untouched", plain.Email, err)
+	}
+
+	// a dotted path only applies beneath its own type
+	office := &vendorOffice{Address: vendorAddress{Street: "1007 Mountain Dr"}}
+	if err := opt.Encrypt(office); err != nil || office.Address.Street != "1007 Mountain Dr" {
+		t.Errorf("Street = %q, %v, want untouched", office.Address.Street, err)
+	}
+}
+
+func TestOptionRegisterScope(t *testing.T) {
+	opt := newTestOption(t)
+	err := opt.RegisterRules(map[reflect.Type]Rules{
+		reflect.TypeOf(vendorAddress{}): {"Street": "aes", "Geo.Label": "aes"},
+		reflect.TypeOf(vendorUser{}):    {"Address.Street": "-", "Address.Geo.Label": "des"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &vendorUser{Address: &vendorAddress{Street: "1007 Mountain Dr", Geo: vendorGeo{Label: "cave"}}}
+	office := &vendorOffice{Address: vendorAddress{Street: "1007 Mountain Dr", Geo: vendorGeo{Label: "cave"}}}
+	if err := opt.Encrypt(user); err != nil {
+		t.Fatal(err)
+	}
+	if err := opt.Encrypt(office); err != nil {
+		t.Fatal(err)
+	}
+	if user.Address.Street != "1007 Mountain Dr" {
+		t.Errorf("user Street = %q, want excluded by the path rule", user.Address.Street)
+	}
+	if office.Address.Street == "1007 Mountain Dr" || office.Address.Geo.Label == "cave" {
+		t.Errorf("office = %+v, want the rules of vendorAddress", office.Address)
+	}
+
+	// the path rule decrypts with des, the type rule with aes
+	if err := opt.Decrypt(user); err != nil || user.Address.Geo.Label != "cave" {
+		t.Errorf("user Label = %q, %v", user.Address.Geo.Label, err)
+	}
+	if err := opt.Decrypt(office); err != nil || office.Address.Street != "1007 Mountain Dr" {
+		t.Errorf("office Street = %q, %v", office.Address.Street, err)
+	}
+}
+
+func TestOptionRegisterTypeCache(t *testing.T) {
+	cached := func() int {
+		n := 0
+		typeCache.Range(func(_, _ interface{}) bool {
+			n++
+			return true
+		})
+		return n
+	}
+
+	before := cached()
+	for i := 0; i < 10; i++ {
+		opt := newTestOption(t)
+		if err := opt.Register(reflect.TypeOf(vendorUser{}), Rules{"Email": "aes", "Address.Street": "aes"}); err != nil {
+			t.Fatal(err)
+		}
+		data := &vendorUser{Email: "bruce@wayne.com", Address: &vendorAddress{Street: "1007 Mountain Dr"}}
+		if err := opt.Encrypt(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if after := cached(); after != before {
+		t.Errorf("type cache grew from %d to %d entries, want rules cached with their option", before, after)
+	}
+}
+
+func TestOptionLoadRules(t *testing.T) {
+	opt := newTestOption(t)
+	doc := `{"github.com/firdasafridi/gocrypt.vendorUser": {"Email": "rc4", "Address.Geo.Label": "aes"}}`
+	if err := opt.LoadRules(strings.NewReader(doc), reflect.TypeOf(&vendorUser{})); err != nil {
+		t.Fatal(err)
+	}
+	data := &vendorUser{Email: "bruce@wayne.com", Address: &vendorAddress{Geo: vendorGeo{Label: "cave"}}}
+	if err := opt.Encrypt(data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Email == "bruce@wayne.com" || data.Address.Geo.Label == "cave" {
+		t.Errorf("loaded rules not applied: %+v %+v", data, data.Address)
+	}
+
+	tests := []struct {
+		doc  string
+		want error
+	}{
+		{`{"vendor.Missing": {"Email": "aes"}}`, ErrUnsupportedType},
+		{`{"github.com/firdasafridi/gocrypt.vendorUser": {"Nope": "aes"}}`, ErrInvalidTag},
+		{`{"github.com/firdasafridi/gocrypt.vendorUser": {"Email.Host": "aes"}}`, ErrInvalidTag},
+		{`{"github.com/firdasafridi/gocrypt.vendorUser": {"Email": "aes,bogus"}}`, ErrInvalidTag},
+		{`not json`, ErrInvalidTag},
+	}
+	for _, tt := range tests {
+		err := newTestOption(t).LoadRules(strings.NewReader(tt.doc), reflect.TypeOf(vendorUser{}))
+		if !errors.Is(err, tt.want) {
+			t.Errorf("LoadRules(%s) = %v, want %v", tt.doc, err, tt.want)
+		}
+	}
+}
+
+type selectProfile struct {
+	PhoneNumber string `gocrypt:"aes"`
+	Email       string `gocrypt:"aes"`
+	Nickname    string
+}
+
+type selectIdentity struct {
+	ID string `gocrypt:"des"`
+}
+
+type selectStruct struct {
+	Profile  selectProfile
+	Identity *selectIdentity
+	Items    []selectProfile
+}
+
+func newSelectStruct() *selectStruct {
+	return &selectStruct{
+		Profile:  selectProfile{PhoneNumber: "+621", Email: "bruce@wayne.com", Nickname: "bats"},
+		Identity: &selectIdentity{ID: "3171"},
+		Items:    []selectProfile{{Email: "a@wayne.com"}, {Email: "b@wayne.com"}},
+	}
+}
+
+func TestOptionOnlyExcept(t *testing.T) {
+	opt := newTestOption(t)
+	plain := newSelectStruct()
+	reset := func() *selectStruct {
+		data := newSelectStruct()
+		if err := opt.Encrypt(data); err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	// an encrypted empty PhoneNumber is not empty
+	data := reset()
+	if err := opt.Decrypt(data, Only("Profile.PhoneNumber", "Identity", "Items.Email")); err != nil {
+		t.Fatal(err)
+	}
+	if data.Profile.PhoneNumber != plain.Profile.PhoneNumber || data.Identity.ID != plain.Identity.ID ||
+		data.Items[1].Email != plain.Items[1].Email {
+		t.Errorf("selected fields not decrypted: %+v %+v", data, data.Identity)
+	}
+	if data.Profile.Email == plain.Profile.Email || data.Items[0].PhoneNumber == "" {
+		t.Errorf("unselected fields decrypted: %+v", data)
+	}
+
+	data = reset()
+	if err := opt.Decrypt(data, Except("Profile", "Items.PhoneNumber")); err != nil {
+		t.Fatal(err)
+	}
+	if data.Profile.PhoneNumber == plain.Profile.PhoneNumber || data.Profile.Email == plain.Profile.Email ||
+		data.Items[0].PhoneNumber == "" {
+		t.Errorf("excepted fields decrypted: %+v", data)
+	}
+	if data.Identity.ID != plain.Identity.ID || data.Items[0].Email != plain.Items[0].Email {
+		t.Errorf("other fields not decrypted: %+v %+v", data, data.Identity)
+	}
+
+	// Except wins over Only
+	data = reset()
+	if err := opt.Decrypt(data, Only("Profile"), Except("Profile.Email")); err != nil {
+		t.Fatal(err)
+	}
+	if data.Profile.PhoneNumber != plain.Profile.PhoneNumber || data.Profile.Email == plain.Profile.Email {
+		t.Errorf("Only/Except = %+v", data.Profile)
+	}
+
+	// Only with an empty list selects nothing
+	data = reset()
+	encrypted := *data.Identity
+	var fields []string
+	if err := opt.Decrypt(data, Only(fields...)); err != nil {
+		t.Fatal(err)
+	}
+	if data.Profile.Email == plain.Profile.Email || *data.Identity != encrypted || data.Items[0].Email == plain.Items[0].Email {
+		t.Errorf("Only() decrypted fields: %+v %+v", data, data.Identity)
+	}
+
+	for _, path := range []string{"Profile.Phone", "Profile.Nickname", "Profile.Email.Host", "Nope"} {
+		err := opt.Decrypt(reset(), Only(path))
+		if !errors.Is(err, ErrUnknownField) {
+			t.Errorf("Only(%q) = %v, want ErrUnknownField", path, err)
+		}
+	}
+}
+
+type tenantKey struct{}
+
+// tenantOpt prefixes values with the tenant of the context, and cancels the
+// call after a number of values
+type tenantOpt struct {
+	upperOpt
+	cancel func()
+	left   int
+}
+
+func (o *tenantOpt) EncryptContext(ctx context.Context, plainText []byte) (string, error) {
+	if o.left--; o.left == 0 && o.cancel != nil {
+		o.cancel()
+	}
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant + ":" + string(plainText), nil
+}
+
+func (o *tenantOpt) DecryptContext(ctx context.Context, cipherText []byte) (string, error) {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return strings.TrimPrefix(string(cipherText), tenant+":"), nil
+}
+
+type tenantStruct struct {
+	Name string `gocrypt:"tenant"`
+}
+
+func TestOptionContext(t *testing.T) {
+	ctxOpt := &tenantOpt{}
+	opt := &Option{Custom: map[string]GocryptOption{"tenant": ctxOpt}}
+	ctx := context.WithValue(context.Background(), tenantKey{}, "acme")
+
+	data := &tenantStruct{Name: "bruce"}
+	if err := opt.EncryptContext(ctx, data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Name != "acme:bruce" {
+		t.Errorf("Name = %q, want the tenant of the context", data.Name)
+	}
+	if err := opt.DecryptContext(ctx, data); err != nil || data.Name != "bruce" {
+		t.Errorf("Name = %q, %v", data.Name, err)
+	}
+
+	// the walk stops once the context is done
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ctxOpt.cancel, ctxOpt.left = cancel, 2
+	items := []tenantStruct{{Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}}
+	err := opt.EncryptContext(ctx, items)
+	if !errors.Is(err, context.Canceled) || !strings.Contains(err.Error(), "stopped at [2]") {
+		t.Errorf("err = %v, want context.Canceled at [2]", err)
+	}
+	if items[1].Name != "acme:b" || items[2].Name != "c" {
+		t.Errorf("items = %+v, want the walk to stop after [1]", items)
+	}
+}
+
+type workerRecord struct {
+	Email string `gocrypt:"aes256gcm"`
+	Code  string `gocrypt:"failing"`
+}
+
+func TestOptionWorkers(t *testing.T) {
+	opt := newTestOption(t)
+	opt.Custom = map[string]GocryptOption{"failing": failingOpt{}}
+
+	records := make([]workerRecord, 1000)
+	for i := range records {
+		records[i] = workerRecord{Email: "user" + strconv.Itoa(i) + "@wayne.com", Code: "ok"}
+	}
+	if err := opt.Encrypt(records, Workers(8)); err != nil {
+		t.Fatal(err)
+	}
+	if err := opt.Decrypt(&records, Workers(8)); err != nil {
+		t.Fatal(err)
+	}
+	for i, record := range records {
+		if record.Email != "user"+strconv.Itoa(i)+"@wayne.com" {
+			t.Fatalf("records[%d].Email = %q", i, record.Email)
+		}
+	}
+
+	// the error of the lowest index wins, whatever the scheduling, and in
+	// atomic mode nothing is written
+	if err := opt.Encrypt(records, Workers(8)); err != nil {
+		t.Fatal(err)
+	}
+	records[700].Code, records[300].Code, records[301].Code = "bad", "bad", "bad"
+	opt.Atomic = true
+	err := opt.Decrypt(records, Workers(8))
+	var fieldErr *FieldError
+	if !errors.As(err, &fieldErr) || fieldErr.Path != "[300].Code" {
+		t.Errorf("err = %v, want the error of [300]", err)
+	}
+
+	opt.Atomic, opt.ContinueOnError = false, true
+	err = opt.Decrypt(records, Workers(8))
+	multiErr, ok := err.(*MultiError)
+	if !ok || len(multiErr.Errors) != 3 || !strings.HasPrefix(multiErr.Errors[1].Error(), "[301].Code") ||
+		!strings.HasPrefix(multiErr.Errors[2].Error(), "[700].Code") {
+		t.Errorf("err = %v, want the errors of [300], [301] and [700] in order", err)
+	}
+}
+
+type sharedRecord struct {
+	Contact *Contact
+	Note    *string           `gocrypt:"aes"`
+	Labels  map[string]string `gocrypt:"aes"`
+	Tags    []string          `gocrypt:"aes"`
+}
+
+func TestOptionWorkersSharedPointers(t *testing.T) {
+	opt := newTestOption(t)
+
+	contact := &Contact{Email: "bruce@wayne.com"}
+	note := "vip"
+	labels := map[string]string{"team": "red"}
+	tags := []string{"gold"}
+	records := make([]sharedRecord, 64)
+	for i := range records {
+		records[i] = sharedRecord{Contact: contact, Note: &note, Labels: labels, Tags: tags}
+	}
+	// shared values are transformed once, whichever goroutine gets them
+	if err := opt.Encrypt(records, Workers(8)); err != nil {
+		t.Fatal(err)
+	}
+	if contact.Email == "bruce@wayne.com" || note == "vip" || labels["team"] == "red" || tags[0] == "gold" {
+		t.Fatalf("shared values not encrypted: %q, %q, %v, %v", contact.Email, note, labels, tags)
+	}
+	if err := opt.Decrypt(records); err != nil {
+		t.Fatal(err)
+	}
+	if contact.Email != "bruce@wayne.com" || note != "vip" || labels["team"] != "red" || tags[0] != "gold" {
+		t.Errorf("shared values = %q, %q, %v, %v, want them encrypted once", contact.Email, note, labels, tags)
+	}
+}
+
+// collect drains the channels of a pipeline
+func collect(out <-chan interface{}, errc <-chan error) ([]interface{}, []error) {
+	var records []interface{}
+	var errs []error
+	for out != nil || errc != nil {
+		select {
+		case record, ok := <-out:
+			if !ok {
+				out = nil
+				continue
+			}
+			records = append(records, record)
+		case err, ok := <-errc:
+			if !ok {
+				errc = nil
+				continue
+			}
+			errs = append(errs, err)
+		}
+	}
+	return records, errs
+}
+
+func TestPipeline(t *testing.T) {
+	opt := newTestOption(t)
+	opt.Custom = map[string]GocryptOption{"failing": failingOpt{}}
+
+	feed := func(n int) <-chan interface{} {
+		in := make(chan interface{})
+		go func() {
+			defer close(in)
+			for i := 0; i < n; i++ {
+				code := "ok"
+				if i%10 == 3 {
+					code = "bad"
+				}
+				in <- &workerRecord{Email: "user" + strconv.Itoa(i) + "@wayne.com", Code: code}
+			}
+		}()
+		return in
+	}
+
+	ctx := context.Background()
+	records, errs := collect(Pipeline(ctx, opt, feed(100), Concurrency(4)))
+	if len(records) != 90 || len(errs) != 10 {
+		t.Fatalf("got %d records and %d errors, want 90 and 10", len(records), len(errs))
+	}
+	for i, err := range errs {
+		var recordErr *RecordError
+		if !errors.As(err, &recordErr) || recordErr.Index != i*10+3 {
+			t.Errorf("errs[%d] = %v, want record %d", i, err, i*10+3)
+		}
+	}
+
+	// decrypt the encrypted records, in order
+	in := make(chan interface{}, len(records))
+	for _, record := range records {
+		in <- record
+	}
+	close(in)
+	decrypted, errs := collect(DecryptPipeline(ctx, opt, in, Concurrency(4)))
+	if len(errs) > 0 || len(decrypted) != 90 {
+		t.Fatalf("got %d records and errors %v", len(decrypted), errs)
+	}
+	index := 0
+	for i, record := range decrypted {
+		if index%10 == 3 {
+			index++ // failed to encrypt
+		}
+		if got := record.(*workerRecord).Email; got != "user"+strconv.Itoa(index)+"@wayne.com" {
+			t.Fatalf("decrypted[%d].Email = %q, want record %d", i, got, index)
+		}
+		index++
+	}
+
+	records, errs = collect(Pipeline(ctx, opt, feed(50), Concurrency(8), Unordered()))
+	if len(records) != 45 || len(errs) != 5 {
+		t.Errorf("unordered: got %d records and %d errors, want 45 and 5", len(records), len(errs))
+	}
+
+	// cancelling closes both channels
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	records, _ = collect(Pipeline(ctx, opt, make(chan interface{}), Concurrency(2)))
+	if len(records) != 0 {
+		t.Errorf("got %d records after cancel", len(records))
+	}
+}
+
+// generatedStruct has methods as cmd/gocrypt-gen would write them, and
+// counts their calls
+type generatedStruct struct {
+	Email string `gocrypt:"aes"`
+	calls int
+}
+
+func (v *generatedStruct) EncryptFields(opt *Option) error {
+	return v.gocryptFields(opt.EncryptValue)
+}
+
+func (v *generatedStruct) DecryptFields(opt *Option) error {
+	return v.gocryptFields(opt.DecryptValue)
+}
+
+func (v *generatedStruct) gocryptFields(transform func(tag, value string) (string, error)) error {
+	v.calls++
+	s, err := transform("aes", v.Email)
+	if err != nil {
+		return &FieldError{Path: "Email", Tag: "aes", Err: err}
+	}
+	v.Email = s
+	return nil
+}
+
+func TestOptionGeneratedMethods(t *testing.T) {
+	opt := newTestOption(t)
+	data := &generatedStruct{Email: "bruce@wayne.com"}
+	if err := opt.Encrypt(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := opt.Decrypt(data); err != nil {
+		t.Fatal(err)
+	}
+	if data.calls != 2 || data.Email != "bruce@wayne.com" {
+		t.Errorf("calls = %d, Email = %q, want the generated methods used", data.calls, data.Email)
+	}
+
+	// options the generated methods don't cover fall back to reflection
+	opt.ContinueOnError = true
+	if err := opt.Encrypt(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := opt.DecryptContext(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+	if data.calls != 2 || data.Email != "bruce@wayne.com" {
+		t.Errorf("calls = %d, Email = %q, want reflection", data.calls, data.Email)
+	}
+
+	err := NestFieldError("Items[3]", &FieldError{Path: "Email", Tag: "aes", Err: ErrMalformedCiphertext})
+	if err.Error() != "Items[3].Email (aes): malformed ciphertext" {
+		t.Errorf("NestFieldError = %v", err)
+	}
+}
+
+func TestOptionFieldAllocs(t *testing.T) {
+	opt := newTestOption(t)
+	ctx := context.Background()
+	for _, algo := range []string{"aes", "aes256gcm", "des", "rc4"} {
+		for _, encoding := range []string{"", "base64"} {
+			tag := tagOptions{algo: algo, encoding: encoding}
+			cipherText, err := opt.encrypt(ctx, tag, "john.doe@example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			encrypt := testing.AllocsPerRun(100, func() {
+				_, _ = opt.encrypt(ctx, tag, "john.doe@example.com")
+			})
+			decrypt := testing.AllocsPerRun(100, func() {
+				_, _ = opt.decrypt(ctx, tag, cipherText)
+			})
+			// the resulting string is the only allocation
+			if encrypt > 1 || decrypt > 1 {
+				t.Errorf("%s enc=%q: %v allocs to encrypt, %v to decrypt, want 1", algo, encoding, encrypt, decrypt)
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package gocrypt
+
+import (
+	"reflect"
+	"sync"
+)
+
+// inspectRoot walks the value passed to a call. With more than one worker,
+// the elements of a slice or array are split in contiguous ranges walked by
+// their own goroutine.
+func (w *walker) inspectRoot(val reflect.Value) error {
+	elems := val
+	for elems.Kind() == reflect.Ptr && !elems.IsNil() {
+		elems = elems.Elem()
+	}
+	if w.workers < 2 || (elems.Kind() != reflect.Slice && elems.Kind() != reflect.Array) ||
+		elems.Len() < 2 || !containsStruct(elems.Type().Elem()) {
+		return w.inspectField(val, 0)
+	}
+
+	n := elems.Len()
+	workers := w.workers
+	if workers > n {
+		workers = n
+	}
+	// the forks share one visited set, so that a struct or string shared by
+	// elements of different ranges is transformed once
+	if w.visited == nil {
+		w.visited = make(map[visit]struct{})
+	}
+	w.visitedMu = &sync.Mutex{}
+	defer func() { w.visitedMu = nil }()
+
+	forks := make([]*walker, workers)
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for k := range forks {
+		forks[k] = w.fork()
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			errs[k] = forks[k].inspectRange(elems, k*n/workers, (k+1)*n/workers)
+		}(k)
+	}
+	wg.Wait()
+
+	// merge in index order, so errors and staged writes don't depend on scheduling
+	for k, fork := range forks {
+		if errs[k] != nil {
+			return errs[k]
+		}
+		w.errs = append(w.errs, fork.errs...)
+		w.pending = append(w.pending, fork.pending...)
+	}
+	return nil
+}
+
+// inspectRange walks the elements [lo, hi) of a slice or array
+func (w *walker) inspectRange(val reflect.Value, lo, hi int) error {
+	for i := lo; i < hi; i++ {
+		w.push(pathElem{index: i})
+		err := w.inspectField(val.Index(i), 0)
+		w.pop()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fork returns a walker with the configuration and visited set of w, and
+// its own state otherwise
+func (w *walker) fork() *walker {
+	fork := *w
+	fork.path = nil
+	fork.errs = nil
+	fork.pending = nil
+	fork.validated = nil
+	return &fork
+}
@@ -0,0 +1,173 @@
+package gocrypt
+
+import (
+	"context"
+	"sync"
+)
+
+// PipelineOption changes how Pipeline and DecryptPipeline run
+type PipelineOption func(*pipelineConfig)
+
+type pipelineConfig struct {
+	concurrency int
+	unordered   bool
+	callOpts    []CallOption
+}
+
+// Concurrency transforms up to n records at the same time, 1 by default
+func Concurrency(n int) PipelineOption {
+	return func(c *pipelineConfig) {
+		c.concurrency = n
+	}
+}
+
+// Unordered emits records and errors as soon as they are done, instead of in
+// input order
+func Unordered() PipelineOption {
+	return func(c *pipelineConfig) {
+		c.unordered = true
+	}
+}
+
+// CallOptions passes opts to every Encrypt or Decrypt of a pipeline, e.g.
+// CallOptions(Only("Email"))
+func CallOptions(opts ...CallOption) PipelineOption {
+	return func(c *pipelineConfig) {
+		c.callOpts = append(c.callOpts, opts...)
+	}
+}
+
+// pipelineRecord is a record of a pipeline with its position in the input
+type pipelineRecord struct {
+	index  int
+	record interface{}
+	err    error
+}
+
+// Pipeline encrypts a stream of records with opt.EncryptContext. Records are
+// emitted on the first channel once encrypted, by default in input order. A
+// record that fails is not emitted, its *RecordError is sent on the second
+// channel instead. Records must be pointers, as for Encrypt.
+//
+// At most twice the concurrency records are in flight, so a slow consumer
+// slows down the reading of in. Both channels must be drained. They are
+// closed once in is closed and every record is done, or as soon as ctx is
+// done, in which case records in flight are dropped.
+func Pipeline(ctx context.Context, opt *Option, in <-chan interface{}, settings ...PipelineOption) (<-chan interface{}, <-chan error) {
+	return opt.pipeline(ctx, in, false, settings)
+}
+
+// DecryptPipeline decrypts a stream of records with opt.DecryptContext, see
+// Pipeline.
+func DecryptPipeline(ctx context.Context, opt *Option, in <-chan interface{}, settings ...PipelineOption) (<-chan interface{}, <-chan error) {
+	return opt.pipeline(ctx, in, true, settings)
+}
+
+func (opt *Option) pipeline(ctx context.Context, in <-chan interface{}, decrypting bool, settings []PipelineOption) (<-chan interface{}, <-chan error) {
+	cfg := pipelineConfig{concurrency: 1}
+	for _, setting := range settings {
+		setting(&cfg)
+	}
+	if cfg.concurrency < 1 {
+		cfg.concurrency = 1
+	}
+
+	out := make(chan interface{})
+	errc := make(chan error)
+	jobs := make(chan pipelineRecord)
+	results := make(chan pipelineRecord)
+	// a slot is taken when a record is read and given back when it is emitted
+	window := make(chan struct{}, 2*cfg.concurrency)
+
+	go func() {
+		defer close(jobs)
+		for index := 0; ; index++ {
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			var job pipelineRecord
+			select {
+			case record, ok := <-in:
+				if !ok {
+					return
+				}
+				job = pipelineRecord{index: index, record: record}
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case jobs <- job:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(cfg.concurrency)
+	for i := 0; i < cfg.concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				job.err = opt.transform(ctx, job.record, decrypting, cfg.callOpts)
+				select {
+				case results <- job:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	go func() {
+		defer close(out)
+		defer close(errc)
+
+		emit := func(result pipelineRecord) bool {
+			var sent bool
+			if result.err != nil {
+				err := &RecordError{Index: result.index, Record: result.record, Err: result.err}
+				select {
+				case errc <- err:
+					sent = true
+				case <-ctx.Done():
+				}
+			} else {
+				select {
+				case out <- result.record:
+					sent = true
+				case <-ctx.Done():
+				}
+			}
+			<-window
+			return sent
+		}
+
+		pending := make(map[int]pipelineRecord)
+		next := 0
+		for result := range results {
+			if cfg.unordered {
+				if !emit(result) {
+					return
+				}
+				continue
+			}
+			pending[result.index] = result
+			for ready, ok := pending[next]; ok; ready, ok = pending[next] {
+				delete(pending, next)
+				next++
+				if !emit(ready) {
+					return
+				}
+			}
+		}
+	}()
+
+	return out, errc
+}
@@ -2,57 +2,84 @@ package gocrypt
 
 import (
 	"crypto/rc4"
-	"encoding/hex"
-
-	"github.com/pkg/errors"
 )
 
 // RC4Opt is structure of RC4 option
 type RC4Opt struct {
 	secret []byte
+	// keyed is the cipher right after key setup, each message starts from a
+	// copy of it
+	keyed *rc4.Cipher
 }
 
 // NewRC4Opt is function to create new configuration of RC4 algorithm option
 // the secret is used directly as bytes (not hex-encoded)
 func NewRC4Opt(secret string) (*RC4Opt, error) {
-	return &RC4Opt{
+	rc4Opt := &RC4Opt{
 		secret: []byte(secret),
-	}, nil
+	}
+	// an invalid key is reported when used
+	/* #nosec */
+	rc4Opt.keyed, _ = rc4.NewCipher(rc4Opt.secret)
+	return rc4Opt, nil
 }
 
 // Encrypt encrypts the first block in src into dst.
 // Dst and src may point at the same memory.
 func (rc4Opt *RC4Opt) Encrypt(src []byte) (string, error) {
-	if rc4Opt == nil || rc4Opt.secret == nil {
-		return "", errors.New("RC4Opt is not properly initialized")
-	}
-	/* #nosec */
-	cipher, err := rc4.NewCipher(rc4Opt.secret)
-	if err != nil {
-		return "", err
-	}
+	return sealBytes(rc4Opt, encodingHex, src)
+}
+
+// EncryptRaw encrypts src without encoding the result
+func (rc4Opt *RC4Opt) EncryptRaw(src []byte) ([]byte, error) {
 	dst := make([]byte, len(src))
-	cipher.XORKeyStream(dst, src)
-	return hex.EncodeToString(dst), nil
+	copy(dst, src)
+	if err := rc4Opt.seal(dst, len(src)); err != nil {
+		return nil, err
+	}
+	return dst, nil
 }
 
 // Decrypt decrypts the first block in src into dst.
 // Dst and src may point at the same memory.
 func (rc4Opt *RC4Opt) Decrypt(disini []byte) (string, error) {
 	if rc4Opt == nil || rc4Opt.secret == nil {
-		return "", errors.New("RC4Opt is not properly initialized")
+		return "", newError(ErrNotInitialized, "RC4Opt is not properly initialized")
 	}
-	src, err := hex.DecodeString(string(disini))
-	if err != nil {
-		return "", err
+	return openBytes(rc4Opt, encodingHex, disini)
+}
+
+// DecryptRaw decrypts src produced by EncryptRaw.
+// RC4 is symmetric, so it is the same operation as EncryptRaw.
+func (rc4Opt *RC4Opt) DecryptRaw(src []byte) ([]byte, error) {
+	return rc4Opt.EncryptRaw(src)
+}
+
+func (rc4Opt *RC4Opt) prefixLen() int       { return 0 }
+func (rc4Opt *RC4Opt) sealedLen(n int) int  { return n }
+func (rc4Opt *RC4Opt) textEncoding() string { return encodingHex }
+
+// seal XORs the key stream into dst in place
+func (rc4Opt *RC4Opt) seal(dst []byte, n int) error {
+	if rc4Opt == nil || rc4Opt.secret == nil {
+		return newError(ErrNotInitialized, "RC4Opt is not properly initialized")
+	}
+	keyed := rc4Opt.keyed
+	if keyed == nil {
+		var err error
+		/* #nosec */
+		if keyed, err = rc4.NewCipher(rc4Opt.secret); err != nil {
+			return err
+		}
 	}
+	cipher := *keyed
+	cipher.XORKeyStream(dst, dst)
+	return nil
+}
 
-	/* #nosec */
-	cipher, err := rc4.NewCipher(rc4Opt.secret)
-	if err != nil {
-		return "", err
+func (rc4Opt *RC4Opt) open(src []byte) ([]byte, error) {
+	if err := rc4Opt.seal(src, len(src)); err != nil {
+		return nil, err
 	}
-	dst := make([]byte, len(src))
-	cipher.XORKeyStream(dst, src)
-	return string(dst), nil
+	return src, nil
 }
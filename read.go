@@ -1,221 +1,919 @@
 package gocrypt
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
 	"reflect"
+	"strings"
 	"sync"
+
+	"github.com/pkg/errors"
 )
 
-type changesValue func(string, string) (string, error)
+type changesValue func(tag tagOptions, value string) (string, error)
 
 // fieldInfo caches metadata about a struct field
 type fieldInfo struct {
 	index     int
-	tag       string
+	name      string
+	tag       tagOptions
 	fieldType reflect.Type
+	scope     *ruleNode // rules of the path beneath the field
+	invalid   string    // why a tagged field can't be transformed or its tag is malformed
+	companion int       // index of the into= field
 }
 
 // typeInfo caches metadata about a struct type
 type typeInfo struct {
-	stringFields []fieldInfo // fields with gocrypt tags that are strings
-	structFields []int       // indexes of fields that are structs
+	stringFields []fieldInfo // fields with gocrypt tags that hold a string
+	structFields []fieldInfo // fields that are or hold structs, with the tag their leaves inherit
+	intoFields   []fieldInfo // fields encrypted into a companion field
+
+	invalidFields []fieldInfo // fields with gocrypt tags that can't be transformed
 }
 
 var (
-	typeCache sync.Map // map[reflect.Type]*typeInfo
+	typeCache sync.Map // map[typeKey]*typeInfo
+
+	nullStringType = reflect.TypeOf(sql.NullString{})
 )
 
+// isStringType reports whether a tagged field of typ holds strings gocrypt
+// can transform: string, sql.NullString, []byte, json.RawMessage, or a
+// pointer to, slice, array or map of those.
+func isStringType(typ reflect.Type) bool {
+	switch {
+	case typ == nullStringType, isBytesType(typ):
+		return true
+	case typ.Kind() == reflect.Ptr,
+		typ.Kind() == reflect.Slice,
+		typ.Kind() == reflect.Array,
+		typ.Kind() == reflect.Map:
+		return isStringType(typ.Elem())
+	default:
+		return typ.Kind() == reflect.String
+	}
+}
+
+// containsStruct reports whether values of typ may hold a struct, directly
+// or through interfaces, pointers, slices, arrays and maps.
+func containsStruct(typ reflect.Type) bool {
+	switch typ.Kind() {
+	case reflect.Struct, reflect.Interface:
+		return true
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		return containsStruct(typ.Elem())
+	default:
+		return false
+	}
+}
+
+func isStringKeyMap(typ reflect.Type) bool {
+	return typ.Kind() == reflect.Map && typ.Key().Kind() == reflect.String
+}
+
+// companionField returns the index of the into= field of a tagged field, or
+// why it can't be used.
+func companionField(typ reflect.Type, field reflect.StructField, name string) (int, string) {
+	if !isScalarType(field.Type) && !isBlobType(field.Type) {
+		return 0, "tag on unsupported type " + field.Type.String()
+	}
+	companion, ok := typ.FieldByName(name)
+	switch {
+	case !ok || len(companion.Index) != 1:
+		return 0, "into field " + name + " doesn't exist"
+	case companion.PkgPath != "":
+		return 0, "into field " + name + " is unexported"
+	case !isTextType(companion.Type):
+		return 0, "into field " + name + " is not a string or []byte"
+	}
+	return companion.Index[0], ""
+}
+
+// typeKey identifies cached type information. The same struct type is
+// cached once per tag name, since each tag name is an independent scheme,
+// once per tag inherited from a dive field, and once per set of rules and
+// rule path.
+type typeKey struct {
+	typ     reflect.Type
+	tagName string
+	inherit tagOptions // tag of the enclosing dive field, zero outside of one
+	rules   *registry
+	scope   *ruleNode // rules of the path the type was reached by
+}
+
 // getTypeInfo returns cached type information, computing it if necessary
-func getTypeInfo(typ reflect.Type) *typeInfo {
+func getTypeInfo(key typeKey) *typeInfo {
+	typ, tagName, inherit := key.typ, key.tagName, key.inherit
 	if typ.Kind() != reflect.Struct {
 		return nil
 	}
 
-	// Check cache first
-	if cached, ok := typeCache.Load(typ); ok {
+	// Check cache first, types with rules are cached along with them
+	cache := &typeCache
+	if key.rules != nil {
+		cache = &key.rules.cache
+	}
+	if cached, ok := cache.Load(key); ok {
 		return cached.(*typeInfo)
 	}
 
 	// Compute type info
 	info := &typeInfo{
 		stringFields: make([]fieldInfo, 0),
-		structFields: make([]int, 0),
+		structFields: make([]fieldInfo, 0),
 	}
 
 	numFields := typ.NumField()
 	for i := 0; i < numFields; i++ {
 		field := typ.Field(i)
-		tag := field.Tag.Get(GOCRYPT)
+		tagValue, tagged := field.Tag.Lookup(tagName)
+		if rule, ok := key.rules.lookup(typ, key.scope, field.Name); ok {
+			tagValue, tagged = rule, true
+		}
+		tag, tagErr := parseTag(tagValue)
+		if tagged && tag.skip {
+			// explicitly excluded
+			continue
+		}
+		if !tagged && inherit.dive && field.PkgPath == "" &&
+			(isStringType(field.Type) || (inherit.keys && isStringKeyMap(field.Type))) {
+			// string leaf beneath a dive field
+			tag, tagged = inherit, true
+		}
+		structInfo := fieldInfo{
+			index:     i,
+			name:      field.Name,
+			fieldType: field.Type,
+			scope:     key.rules.scope(typ, key.scope, field.Name),
+		}
+		if !tagged {
+			structInfo.tag = inherit
+		}
 
-		// Only cache fields that have gocrypt tags or are structs
-		if len(tag) > 0 {
+		// Only cache fields that have gocrypt tags or are structs, an empty
+		// tag stands for the default algorithm
+		if tagged {
+			fieldInfo := fieldInfo{
+				index:     i,
+				name:      field.Name,
+				tag:       tag,
+				fieldType: field.Type,
+			}
 			// Check if it's a string type (we'll validate at runtime)
-			if field.Type.Kind() == reflect.String {
-				info.stringFields = append(info.stringFields, fieldInfo{
-					index:     i,
-					tag:       tag,
-					fieldType: field.Type,
-				})
+			switch {
+			case field.PkgPath != "" && !(field.Anonymous && containsStruct(field.Type)):
+				// the exported fields of an unexported embedded struct
+				// can still be written
+				fieldInfo.invalid = "tag on unexported field"
+				info.invalidFields = append(info.invalidFields, fieldInfo)
+			case tag.into != "":
+				fieldInfo.companion, fieldInfo.invalid = companionField(typ, field, tag.into)
+				if fieldInfo.invalid != "" {
+					info.invalidFields = append(info.invalidFields, fieldInfo)
+					break
+				}
+				if tagErr != nil {
+					fieldInfo.invalid = tagErr.Error()
+				}
+				info.intoFields = append(info.intoFields, fieldInfo)
+				// the field is encrypted as a whole, not walked
+				continue
+			case isStringType(field.Type) || (tag.keys && isStringKeyMap(field.Type)):
+				if tagErr != nil {
+					fieldInfo.invalid = tagErr.Error()
+				}
+				info.stringFields = append(info.stringFields, fieldInfo)
+			case tag.dive && containsStruct(field.Type):
+				structInfo.tag = tag
+				if tagErr != nil {
+					structInfo.invalid = tagErr.Error()
+				}
+			case isBlobType(field.Type):
+				fieldInfo.invalid = "tag on " + field.Type.String() + " needs into=FIELD to encrypt it as one value"
+				info.invalidFields = append(info.invalidFields, fieldInfo)
+			default:
+				fieldInfo.invalid = "tag on unsupported type " + field.Type.String()
+				info.invalidFields = append(info.invalidFields, fieldInfo)
 			}
 		}
 
-		// Cache struct fields for nested inspection
-		if field.Type.Kind() == reflect.Struct {
-			info.structFields = append(info.structFields, i)
-		} else if field.Type.Kind() == reflect.Ptr {
-			// Check if it's a pointer to struct
-			if field.Type.Elem().Kind() == reflect.Struct {
-				info.structFields = append(info.structFields, i)
-			}
+		// Cache struct and container fields for nested inspection
+		if containsStruct(field.Type) {
+			info.structFields = append(info.structFields, structInfo)
 		}
 	}
 
 	// Cache the result
-	typeCache.Store(typ, info)
+	cache.Store(key, info)
 	return info
 }
 
-func read(v interface{}, encDec changesValue) error {
-	switch reflect.TypeOf(v).Kind() {
-	case reflect.Slice:
-		valueOfV := reflect.ValueOf(v)
-		for i := 0; i < valueOfV.Len(); i++ {
-			err := inspectField(valueOfV.Index(i), encDec)
-			if err != nil {
-				return err
+// walker holds the state of a single Encrypt or Decrypt call
+type walker struct {
+	ctx        context.Context // nil when the call has no context
+	encDec     changesValue
+	decrypting bool
+	tagName    string
+	maxDepth   int                // maximum struct nesting, 0 means unlimited
+	visited    map[visit]struct{} // structs and strings already transformed
+	visitedMu  *sync.Mutex        // guards visited when forks share it
+	path       []pathElem         // path from the walked value to the current one
+
+	continueOnError bool
+	onError         func(*FieldError) ErrorPolicy
+	placeholder     string
+	errs            []error // failures collected in continueOnError mode
+
+	atomic  bool
+	pending []func() // writes staged in atomic mode
+
+	inherit   tagOptions // tag of the enclosing dive field
+	rules     *registry
+	scope     *ruleNode      // rules of the path to the current struct
+	selection fieldSelection // position in the Only and Except trees
+	workers   int            // goroutines walking the elements of a top-level slice
+
+	marked func(value string) bool // tells ciphertext apart when markers are set
+
+	strict    bool
+	checkTag  func(tag tagOptions) error
+	validated map[typeKey]bool // struct types checked in strict mode
+}
+
+// pathElem is one step of a walker path: a struct field, a slice or array
+// index, or a map key.
+type pathElem struct {
+	field string
+	index int
+	key   reflect.Value
+}
+
+// visit identifies an addressable value, or the contents of a map or slice.
+// The type is part of the key because a struct and its first field share the
+// same address, the length because slices of one array may differ in it.
+type visit struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+func newWalker(encDec changesValue) *walker {
+	return &walker{encDec: encDec, tagName: GOCRYPT}
+}
+
+func (w *walker) typeKey(typ reflect.Type, inherit tagOptions, scope *ruleNode) typeKey {
+	return typeKey{typ: typ, tagName: w.tagName, inherit: inherit, rules: w.rules, scope: scope}
+}
+
+// seen marks an addressable value as visited and reports whether it already
+// was. Non-addressable values are never considered seen.
+func (w *walker) seen(val reflect.Value) bool {
+	if !val.CanAddr() {
+		return false
+	}
+	return w.mark(visit{ptr: val.UnsafeAddr(), typ: val.Type()})
+}
+
+// seenContents marks the contents of a map or of the array behind a slice as
+// visited and reports whether they already were, so that a map or slice
+// shared by several values is transformed once. Empty ones are never seen.
+func (w *walker) seenContents(val reflect.Value) bool {
+	if val.IsNil() || val.Len() == 0 {
+		return false
+	}
+	key := visit{ptr: val.Pointer(), typ: val.Type()}
+	if val.Kind() == reflect.Slice {
+		key.len = val.Len()
+	}
+	return w.mark(key)
+}
+
+// mark records a visit and reports whether it was already recorded. With
+// workers, the first goroutine to mark a value claims it, the others skip it.
+func (w *walker) mark(key visit) bool {
+	if w.visitedMu != nil {
+		w.visitedMu.Lock()
+		defer w.visitedMu.Unlock()
+	}
+	if _, ok := w.visited[key]; ok {
+		return true
+	}
+	if w.visited == nil {
+		w.visited = make(map[visit]struct{})
+	}
+	w.visited[key] = struct{}{}
+	return false
+}
+
+func (w *walker) push(elem pathElem) {
+	w.path = append(w.path, elem)
+}
+
+func (w *walker) pop() {
+	w.path = w.path[:len(w.path)-1]
+}
+
+// pathString renders the current path, e.g. Items[3].Email
+func (w *walker) pathString() string {
+	return renderPath(w.path)
+}
+
+func renderPath(path []pathElem) string {
+	var b strings.Builder
+	for _, elem := range path {
+		switch {
+		case elem.field != "":
+			if b.Len() > 0 {
+				b.WriteByte('.')
 			}
+			b.WriteString(elem.field)
+		case elem.key.IsValid():
+			fmt.Fprintf(&b, "[%v]", elem.key.Interface())
+		default:
+			fmt.Fprintf(&b, "[%d]", elem.index)
 		}
-		return nil
-	default:
-		return inspectField(reflect.ValueOf(v), encDec)
 	}
+	return b.String()
 }
 
-func inspectField(val reflect.Value, encDec changesValue) error {
-	if !val.IsValid() {
+// canceled returns the error of the context once it is done
+func (w *walker) canceled() error {
+	if w.ctx == nil {
 		return nil
 	}
+	err := w.ctx.Err()
+	if err != nil && len(w.path) > 0 {
+		return errors.Wrap(err, "stopped at "+w.pathString())
+	}
+	return err
+}
 
-	// Handle interface types
-	if val.Kind() == reflect.Interface && !val.IsNil() {
-		elm := val.Elem()
-		if elm.IsValid() && elm.Kind() == reflect.Ptr && !elm.IsNil() {
-			elmElem := elm.Elem()
-			if elmElem.IsValid() && elmElem.Kind() == reflect.Ptr {
-				val = elm
-			}
+// fieldError attaches the current path and tag to an error of encDec
+func (w *walker) fieldError(tag tagOptions, err error) *FieldError {
+	return &FieldError{Path: w.pathString(), Tag: tag.algo, Err: err}
+}
+
+// fail handles the failure of the string, []byte or json.RawMessage val. It returns the error, or in
+// continueOnError mode records it, applies the error policy to val and
+// returns nil so the walk goes on.
+func (w *walker) fail(val reflect.Value, tag tagOptions, err error) error {
+	fieldErr := w.fieldError(tag, err)
+	if !w.continueOnError {
+		return fieldErr
+	}
+
+	policy := KeepOnError
+	if w.onError != nil {
+		policy = w.onError(fieldErr)
+	}
+	switch policy {
+	case ReplaceOnError:
+		w.setValue(val, textValue(val.Type(), w.placeholder, true))
+	case ClearOnError:
+		w.setValue(val, reflect.Zero(val.Type()))
+	}
+	w.errs = append(w.errs, fieldErr)
+	return nil
+}
+
+func (w *walker) read(v interface{}) error {
+	val := reflect.ValueOf(v)
+	if w.strict && val.IsValid() {
+		if val.Kind() == reflect.Struct || val.Kind() == reflect.Array {
+			return newError(ErrNotAddressable, val.Type().String()+" is passed by value, pass a pointer to it")
 		}
+		// Check every statically reachable type before anything is written
+		if err := w.validateType(val.Type(), tagOptions{}, nil); err != nil {
+			return err
+		}
+	}
+
+	if err := w.inspectRoot(val); err != nil {
+		return err
+	}
+	if len(w.errs) > 0 {
+		return &MultiError{Errors: w.errs}
 	}
 
-	// Handle pointer types
-	if val.Kind() == reflect.Ptr {
+	// Every field succeeded, commit the staged writes in the order they were made
+	for _, write := range w.pending {
+		write()
+	}
+	return nil
+}
+
+// setString sets a string, or stages the write in atomic mode
+func (w *walker) setString(val reflect.Value, s string) {
+	if w.atomic {
+		w.pending = append(w.pending, func() { val.SetString(s) })
+		return
+	}
+	val.SetString(s)
+}
+
+// setValue sets any value, or stages the write in atomic mode
+func (w *walker) setValue(val, x reflect.Value) {
+	if w.atomic {
+		w.pending = append(w.pending, func() { val.Set(x) })
+		return
+	}
+	val.Set(x)
+}
+
+// setMapIndex sets or deletes a map entry, or stages the write in atomic mode
+func (w *walker) setMapIndex(val, key, elem reflect.Value) {
+	if w.atomic {
+		w.pending = append(w.pending, func() { val.SetMapIndex(key, elem) })
+		return
+	}
+	val.SetMapIndex(key, elem)
+}
+
+// inspectField walks val looking for structs with gocrypt tags. It follows
+// pointers and goes into every element of slices, arrays and maps. depth is
+// the number of structs val is nested in.
+func (w *walker) inspectField(val reflect.Value, depth int) error {
+	if !val.IsValid() {
+		return nil
+	}
+
+	switch val.Kind() {
+	case reflect.Interface:
+		if val.IsNil() {
+			return nil
+		}
+		return w.inspectInterface(val, depth)
+	case reflect.Ptr:
 		if val.IsNil() {
 			return nil
 		}
-		val = val.Elem()
+		return w.inspectField(val.Elem(), depth)
+	case reflect.Slice, reflect.Array:
+		if !containsStruct(val.Type().Elem()) || (val.Kind() == reflect.Slice && w.seenContents(val)) {
+			return nil
+		}
+		for i := 0; i < val.Len(); i++ {
+			w.push(pathElem{index: i})
+			err := w.inspectField(val.Index(i), depth)
+			w.pop()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		return w.inspectMap(val, depth)
+	case reflect.Struct:
+		return w.inspectStruct(val, depth+1)
+	default:
+		return nil
 	}
+}
 
-	if !val.IsValid() {
+// inspectInterface walks the value held by an interface. A pointer is
+// followed in place. A struct or array held by value is not addressable, so
+// it is walked as a copy that then replaces the held value; interfaces
+// reached through unexported fields can't be written and are skipped.
+func (w *walker) inspectInterface(val reflect.Value, depth int) error {
+	elem := val.Elem()
+	if elem.Kind() != reflect.Struct && elem.Kind() != reflect.Array {
+		return w.inspectField(elem, depth)
+	}
+	if !val.CanSet() {
 		return nil
 	}
 
-	if val.Kind() != reflect.Struct {
+	elemCopy := reflect.New(elem.Type()).Elem()
+	elemCopy.Set(elem)
+	if err := w.inspectField(elemCopy, depth); err != nil {
+		return err
+	}
+	w.setValue(val, elemCopy)
+	return nil
+}
+
+// validateType checks in strict mode that every tagged field reachable from
+// typ can be transformed and names a known algorithm. inherit is the tag of
+// the enclosing dive field.
+func (w *walker) validateType(typ reflect.Type, inherit tagOptions, scope *ruleNode) error {
+	switch typ.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		return w.validateType(typ.Elem(), inherit, scope)
+	case reflect.Struct:
+	default:
+		return nil
+	}
+
+	key := w.typeKey(typ, inherit, scope)
+	if w.validated[key] {
+		return nil
+	}
+	if w.validated == nil {
+		w.validated = make(map[typeKey]bool)
+	}
+	w.validated[key] = true
+
+	info := getTypeInfo(key)
+	if len(info.invalidFields) > 0 {
+		fieldInfo := info.invalidFields[0]
+		return newError(ErrUnsupportedType, typ.String()+"."+fieldInfo.name+": "+fieldInfo.invalid)
+	}
+	for _, fieldInfo := range info.stringFields {
+		if fieldInfo.invalid != "" {
+			return newError(ErrInvalidTag, typ.String()+"."+fieldInfo.name+": "+fieldInfo.invalid)
+		}
+		if err := w.checkTag(fieldInfo.tag); err != nil {
+			return errors.Wrap(err, typ.String()+"."+fieldInfo.name)
+		}
+	}
+	for _, fieldInfo := range info.intoFields {
+		if fieldInfo.invalid != "" {
+			return newError(ErrInvalidTag, typ.String()+"."+fieldInfo.name+": "+fieldInfo.invalid)
+		}
+		if err := w.checkTag(fieldInfo.tag); err != nil {
+			return errors.Wrap(err, typ.String()+"."+fieldInfo.name)
+		}
+	}
+	for _, fieldInfo := range info.structFields {
+		if fieldInfo.invalid != "" {
+			return newError(ErrInvalidTag, typ.String()+"."+fieldInfo.name+": "+fieldInfo.invalid)
+		}
+		if fieldInfo.tag.dive && fieldInfo.tag != inherit {
+			if err := w.checkTag(fieldInfo.tag); err != nil {
+				return errors.Wrap(err, typ.String()+"."+fieldInfo.name)
+			}
+		}
+		if err := w.validateType(fieldInfo.fieldType, fieldInfo.tag, fieldInfo.scope); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *walker) inspectStruct(val reflect.Value, depth int) error {
+	// Each addressable struct is transformed once, which also breaks cycles
+	if w.seen(val) {
+		return nil
+	}
+	if err := w.canceled(); err != nil {
+		return err
+	}
+	if w.maxDepth > 0 && depth > w.maxDepth {
+		err := errors.Errorf("max depth %d exceeded at %s (%s)", w.maxDepth, w.pathString(), val.Type())
+		if !w.continueOnError {
+			return err
+		}
+		w.errs = append(w.errs, err)
 		return nil
 	}
 
 	// Get cached type info
 	typeOfS := val.Type()
-	info := getTypeInfo(typeOfS)
+	info := getTypeInfo(w.typeKey(typeOfS, w.inherit, w.scope))
 	if info == nil {
 		return nil
 	}
+	if w.strict {
+		// types only reachable through interfaces are checked when first seen
+		if err := w.validateType(typeOfS, w.inherit, w.scope); err != nil {
+			return err
+		}
+	}
 
 	// Process string fields with gocrypt tags (optimized path)
 	for _, fieldInfo := range info.stringFields {
-		valueField := val.Field(fieldInfo.index)
-		if !valueField.IsValid() {
+		selection, selected := w.selectField(fieldInfo.name)
+		if !selected {
 			continue
 		}
+		valueField := val.Field(fieldInfo.index)
 
-		// Handle interface wrapping
-		if valueField.Kind() == reflect.Interface && !valueField.IsNil() {
-			elm := valueField.Elem()
-			if elm.IsValid() && elm.Kind() == reflect.Ptr && !elm.IsNil() {
-				elmElem := elm.Elem()
-				if elmElem.IsValid() && elmElem.Kind() == reflect.Ptr {
-					valueField = elm
-				}
-			}
+		var err error
+		w.push(pathElem{field: fieldInfo.name})
+		if fieldInfo.tag.keys && valueField.Kind() == reflect.Map {
+			err = w.transformMapKeys(valueField, fieldInfo.tag)
+		} else {
+			err = w.transformString(valueField, fieldInfo.tag)
 		}
+		w.pop()
+		w.selection = selection
+		if err != nil {
+			return err
+		}
+	}
 
-		if valueField.Kind() == reflect.Slice {
-			for i := 0; i < valueField.Len(); i++ {
-				err := inspectField(valueField.Index(i), encDec)
-				if err != nil {
-					return err
-				}
-			}
+	// Process fields encrypted into a companion field
+	for _, fieldInfo := range info.intoFields {
+		selection, selected := w.selectField(fieldInfo.name)
+		if !selected {
 			continue
 		}
-
-		// Handle pointer types
-		if valueField.Kind() == reflect.Ptr {
-			if valueField.IsNil() {
-				continue
-			}
-			valueField = valueField.Elem()
+		w.push(pathElem{field: fieldInfo.name})
+		err := w.transformInto(val.Field(fieldInfo.index), val.Field(fieldInfo.companion), fieldInfo.tag)
+		w.pop()
+		w.selection = selection
+		if err != nil {
+			return err
 		}
+	}
 
-		if !valueField.IsValid() {
+	// Process nested struct and container fields (optimized path)
+	inherit, scope := w.inherit, w.scope
+	for _, fieldInfo := range info.structFields {
+		selection, selected := w.selectField(fieldInfo.name)
+		if !selected {
 			continue
 		}
-
-		// Only process if it's actually a string (runtime check)
-		if valueField.Kind() == reflect.String && valueField.CanSet() {
-			encvalue, err := encDec(fieldInfo.tag, valueField.String())
-			if err != nil {
-				return err
-			}
-			valueField.SetString(encvalue)
+		w.push(pathElem{field: fieldInfo.name})
+		w.inherit, w.scope = fieldInfo.tag, fieldInfo.scope
+		err := w.inspectField(val.Field(fieldInfo.index), depth)
+		w.inherit, w.scope = inherit, scope
+		w.pop()
+		w.selection = selection
+		if err != nil {
+			return err
 		}
 	}
 
-	// Process nested struct fields (optimized path)
-	for _, fieldIdx := range info.structFields {
-		valueField := val.Field(fieldIdx)
-		if !valueField.IsValid() {
-			continue
+	return nil
+}
+
+// inspectMap walks the values of a map. Map values are not addressable, so
+// struct, array and interface values are walked as a copy that is stored
+// back in the map.
+func (w *walker) inspectMap(val reflect.Value, depth int) error {
+	elemType := val.Type().Elem()
+	// maps reached through unexported fields can't be written
+	if val.IsNil() || !val.CanInterface() || !containsStruct(elemType) || w.seenContents(val) {
+		return nil
+	}
+
+	copyBack := elemType.Kind() == reflect.Struct || elemType.Kind() == reflect.Array ||
+		elemType.Kind() == reflect.Interface
+	for _, key := range val.MapKeys() {
+		w.push(pathElem{key: key})
+		err := w.inspectMapValue(val, key, copyBack, depth)
+		w.pop()
+		if err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		// Handle interface wrapping
-		if valueField.Kind() == reflect.Interface && !valueField.IsNil() {
-			elm := valueField.Elem()
-			if elm.IsValid() && elm.Kind() == reflect.Ptr && !elm.IsNil() {
-				elmElem := elm.Elem()
-				if elmElem.IsValid() && elmElem.Kind() == reflect.Ptr {
-					valueField = elm
-				}
+func (w *walker) inspectMapValue(val, key reflect.Value, copyBack bool, depth int) error {
+	elem := val.MapIndex(key)
+	if !copyBack {
+		return w.inspectField(elem, depth)
+	}
+
+	elemCopy := reflect.New(elem.Type()).Elem()
+	elemCopy.Set(elem)
+	if err := w.inspectField(elemCopy, depth); err != nil {
+		return err
+	}
+	w.setMapIndex(val, key, elemCopy)
+	return nil
+}
+
+// transformString applies encDec to a string, sql.NullString, or a pointer
+// to, slice, array or map of either. Nil pointers and invalid sql.NullString
+// values are left alone; map keys are not touched.
+func (w *walker) transformString(val reflect.Value, tag tagOptions) error {
+	switch {
+	case !val.IsValid():
+		return nil
+	case isBytesType(val.Type()):
+		if !val.CanSet() || val.IsNil() || (tag.omitEmpty && isEmptyText(val)) {
+			return nil
+		}
+		return w.transformBytes(val, tag)
+	case val.Kind() == reflect.Ptr:
+		// a string shared by several pointers is transformed once
+		if val.IsNil() || w.seen(val.Elem()) {
+			return nil
+		}
+		return w.transformString(val.Elem(), tag)
+	case val.Kind() == reflect.Slice, val.Kind() == reflect.Array:
+		// a slice shared by several values is transformed once
+		if val.Kind() == reflect.Slice && w.seenContents(val) {
+			return nil
+		}
+		for i := 0; i < val.Len(); i++ {
+			if err := w.canceled(); err != nil {
+				return err
+			}
+			w.push(pathElem{index: i})
+			err := w.transformString(val.Index(i), tag)
+			w.pop()
+			if err != nil {
+				return err
 			}
 		}
-
-		// Handle pointer to struct
-		if valueField.Kind() == reflect.Ptr {
-			if valueField.IsNil() {
-				continue
+	case val.Kind() == reflect.Map:
+		// maps reached through unexported fields can't be written
+		if !val.CanInterface() || !isStringType(val.Type().Elem()) || w.seenContents(val) {
+			return nil
+		}
+		for _, key := range val.MapKeys() {
+			w.push(pathElem{key: key})
+			elem, err := w.transformMapValue(val.MapIndex(key), tag)
+			w.pop()
+			if err != nil {
+				return err
 			}
-			valueField = valueField.Elem()
+			w.setMapIndex(val, key, elem)
+		}
+	case val.Type() == nullStringType:
+		// sql.NullString{String string; Valid bool}
+		if !val.Field(1).Bool() {
+			return nil
+		}
+		return w.transformString(val.Field(0), tag)
+	case val.Kind() == reflect.String && val.CanSet():
+		if tag.omitEmpty && val.Len() == 0 {
+			return nil
 		}
+		encvalue, err := w.encDec(tag, val.String())
+		if err != nil {
+			return w.fail(val, tag, err)
+		}
+		w.setString(val, encvalue)
+	}
+	return nil
+}
 
-		if !valueField.IsValid() {
-			continue
+// transformBytes applies encDec to a []byte or json.RawMessage. The
+// ciphertext of a json.RawMessage is stored as a JSON string, and a
+// json.RawMessage of null is left alone.
+func (w *walker) transformBytes(val reflect.Value, tag tagOptions) error {
+	if val.Type() == rawMessageType && isEmptyText(val) {
+		return nil
+	}
+	if val.Type() == rawMessageType && w.marked != nil {
+		return w.transformMarkedMessage(val, tag)
+	}
+	text, err := getText(val, w.decrypting)
+	if err != nil {
+		return w.fail(val, tag, err)
+	}
+	encvalue, err := w.encDec(tag, text)
+	if err != nil {
+		return w.fail(val, tag, err)
+	}
+	w.setValue(val, textValue(val.Type(), encvalue, !w.decrypting))
+	return nil
+}
+
+// transformMarkedMessage transforms a json.RawMessage when markers tell
+// ciphertext apart. Only a JSON string can hold ciphertext, so Encrypt skips
+// a marked one and Decrypt skips anything else. A value the option leaves
+// unchanged keeps its original bytes.
+func (w *walker) transformMarkedMessage(val reflect.Value, tag tagOptions) error {
+	quoted, isString := jsonString(val)
+	text := string(val.Bytes())
+	switch {
+	case w.decrypting && !isString:
+		// plain text
+		return nil
+	case w.decrypting:
+		text = quoted
+	case isString && w.marked(quoted):
+		// already encrypted
+		return nil
+	}
+
+	encvalue, err := w.encDec(tag, text)
+	if err != nil {
+		return w.fail(val, tag, err)
+	}
+	if encvalue == text {
+		return nil
+	}
+	w.setValue(val, textValue(val.Type(), encvalue, !w.decrypting))
+	return nil
+}
+
+// transformInto encrypts the text form of val into its companion field and
+// zeroes val, or decrypts the companion back into val and clears it. Scalars
+// are encrypted as text, structs, maps, slices and arrays as one JSON
+// document. A non-empty companion means the value is encrypted, so both
+// directions skip values that are already done.
+func (w *walker) transformInto(val, companion reflect.Value, tag tagOptions) error {
+	if !val.CanSet() || !companion.CanSet() {
+		return nil
+	}
+	if w.decrypting {
+		return w.decryptInto(val, companion, tag)
+	}
+
+	if !isEmptyText(companion) || (tag.omitEmpty && val.IsZero()) {
+		return nil
+	}
+	switch val.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice:
+		if val.IsNil() {
+			return nil
 		}
+	}
+	text, err := intoText(val)
+	if err != nil {
+		return w.fail(companion, tag, err)
+	}
+	encvalue, err := w.encDec(tag, text)
+	if err != nil {
+		return w.fail(companion, tag, err)
+	}
+	w.setValue(companion, textValue(companion.Type(), encvalue, true))
+	w.setValue(val, reflect.Zero(val.Type()))
+	return nil
+}
 
-		// Recurse into struct fields
-		if valueField.Kind() == reflect.Struct {
-			if err := inspectField(valueField, encDec); err != nil {
-				return err
-			}
+func (w *walker) decryptInto(val, companion reflect.Value, tag tagOptions) error {
+	if isEmptyText(companion) {
+		return nil
+	}
+	cipherText, err := getText(companion, true)
+	if err != nil {
+		return w.fail(companion, tag, err)
+	}
+	text, err := w.encDec(tag, cipherText)
+	if err != nil {
+		return w.fail(companion, tag, err)
+	}
+
+	decrypted, err := parseInto(val.Type(), text)
+	if err != nil {
+		return w.fail(companion, tag, wrapError(ErrMalformedCiphertext, err, "parseInto"))
+	}
+	w.setValue(val, decrypted)
+	w.setValue(companion, reflect.Zero(companion.Type()))
+	return nil
+}
+
+// transformMapValue transforms an addressable copy of a map value, since map
+// values can't be set in place.
+func (w *walker) transformMapValue(elem reflect.Value, tag tagOptions) (reflect.Value, error) {
+	elemCopy := reflect.New(elem.Type()).Elem()
+	elemCopy.Set(elem)
+	if err := w.transformString(elemCopy, tag); err != nil {
+		return reflect.Value{}, err
+	}
+	return elemCopy, nil
+}
+
+// transformMapKeys transforms the string keys of a map together with its
+// values. The map is rebuilt in place so a new key can't collide with an old
+// one that hasn't been visited yet.
+func (w *walker) transformMapKeys(val reflect.Value, tag tagOptions) error {
+	if val.IsNil() || !val.CanInterface() || w.seenContents(val) {
+		return nil
+	}
+
+	keys := val.MapKeys()
+	newKeys := make([]reflect.Value, len(keys))
+	newElems := make([]reflect.Value, len(keys))
+	for i, key := range keys {
+		w.push(pathElem{key: key})
+		newKey, newElem, err := w.transformMapEntry(val, key, tag)
+		w.pop()
+		if err != nil {
+			return err
 		}
+		newKeys[i], newElems[i] = newKey, newElem
 	}
 
+	for _, key := range keys {
+		w.setMapIndex(val, key, reflect.Value{})
+	}
+	for i, key := range newKeys {
+		w.setMapIndex(val, key, newElems[i])
+	}
 	return nil
 }
+
+func (w *walker) transformMapEntry(val, key reflect.Value, tag tagOptions) (reflect.Value, reflect.Value, error) {
+	newKey := reflect.New(key.Type()).Elem()
+	newKey.Set(key)
+	errs := len(w.errs)
+	if err := w.transformString(newKey, tag); err != nil {
+		return reflect.Value{}, reflect.Value{}, err
+	}
+	if len(w.errs) > errs {
+		// a failed key keeps its value whatever the policy, a placeholder
+		// would merge the entries of several failed keys
+		newKey.Set(key)
+	}
+
+	elem := val.MapIndex(key)
+	if !isStringType(val.Type().Elem()) {
+		return newKey, elem, nil
+	}
+	newElem, err := w.transformMapValue(elem, tag)
+	if err != nil {
+		return reflect.Value{}, reflect.Value{}, err
+	}
+	return newKey, newElem, nil
+}
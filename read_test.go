@@ -1,8 +1,14 @@
 package gocrypt
 
 import (
+	"context"
+	"database/sql"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+
+	"github.com/pkg/errors"
 )
 
 type TestStruct struct {
@@ -47,14 +53,14 @@ func BenchmarkInspectField_Optimized(b *testing.B) {
 		Field5: "test5",
 	}
 
-	encDec := func(algo string, text string) (string, error) {
+	encDec := func(tag tagOptions, text string) (string, error) {
 		return "encrypted_" + text, nil
 	}
 
 	b.ResetTimer()
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
-		_ = inspectField(reflect.ValueOf(testData), encDec)
+		_ = newWalker(encDec).inspectField(reflect.ValueOf(testData), 0)
 	}
 }
 
@@ -73,14 +79,14 @@ func BenchmarkInspectFieldNested_Optimized(b *testing.B) {
 		Level3: "nested",
 	}
 
-	encDec := func(algo string, text string) (string, error) {
+	encDec := func(tag tagOptions, text string) (string, error) {
 		return "encrypted_" + text, nil
 	}
 
 	b.ResetTimer()
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
-		_ = inspectField(reflect.ValueOf(testData), encDec)
+		_ = newWalker(encDec).inspectField(reflect.ValueOf(testData), 0)
 	}
 }
 
@@ -95,14 +101,14 @@ func BenchmarkLargeStruct_Optimized(b *testing.B) {
 		F15: "field15",
 	}
 
-	encDec := func(algo string, text string) (string, error) {
+	encDec := func(tag tagOptions, text string) (string, error) {
 		return "encrypted_" + text, nil
 	}
 
 	b.ResetTimer()
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
-		_ = inspectField(reflect.ValueOf(testData), encDec)
+		_ = newWalker(encDec).inspectField(reflect.ValueOf(testData), 0)
 	}
 }
 
@@ -115,17 +121,17 @@ func BenchmarkInspectField_WithCache(b *testing.B) {
 		Field5: "test5",
 	}
 
-	encDec := func(algo string, text string) (string, error) {
+	encDec := func(tag tagOptions, text string) (string, error) {
 		return "encrypted_" + text, nil
 	}
 
 	// Pre-warm cache
-	_ = inspectField(reflect.ValueOf(testData), encDec)
+	_ = newWalker(encDec).inspectField(reflect.ValueOf(testData), 0)
 
 	b.ResetTimer()
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
-		_ = inspectField(reflect.ValueOf(testData), encDec)
+		_ = newWalker(encDec).inspectField(reflect.ValueOf(testData), 0)
 	}
 }
 
@@ -140,16 +146,579 @@ func BenchmarkLargeStruct_WithCache(b *testing.B) {
 		F15: "field15",
 	}
 
-	encDec := func(algo string, text string) (string, error) {
+	encDec := func(tag tagOptions, text string) (string, error) {
 		return "encrypted_" + text, nil
 	}
 
 	// Pre-warm cache
-	_ = inspectField(reflect.ValueOf(testData), encDec)
+	_ = newWalker(encDec).inspectField(reflect.ValueOf(testData), 0)
 
 	b.ResetTimer()
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
-		_ = inspectField(reflect.ValueOf(testData), encDec)
+		_ = newWalker(encDec).inspectField(reflect.ValueOf(testData), 0)
+	}
+}
+
+// benchCiphers are the tags of the built-in options the cipher benchmarks
+// run on
+var benchCiphers = []string{"aes", "aes256gcm", "des", "rc4"}
+
+func BenchmarkFieldEncrypt(b *testing.B) {
+	opt := newTestOption(b)
+	ctx := context.Background()
+	for _, algo := range benchCiphers {
+		tag := tagOptions{algo: algo}
+		b.Run(algo, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := opt.encrypt(ctx, tag, "john.doe@example.com"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkFieldDecrypt(b *testing.B) {
+	opt := newTestOption(b)
+	ctx := context.Background()
+	for _, algo := range benchCiphers {
+		tag := tagOptions{algo: algo}
+		cipherText, err := opt.encrypt(ctx, tag, "john.doe@example.com")
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(algo, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := opt.decrypt(ctx, tag, cipherText); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkStructRoundTrip(b *testing.B) {
+	opt := newTestOption(b)
+	testData := &LargeStruct{}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		*testData = LargeStruct{
+			F1:  "field1",
+			F3:  "field3",
+			F6:  "field6",
+			F8:  "field8",
+			F10: "field10",
+			F13: "field13",
+			F15: "field15",
+		}
+		if err := opt.Encrypt(testData); err != nil {
+			b.Fatal(err)
+		}
+		if err := opt.Decrypt(testData); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func testEncDec(tag tagOptions, text string) (string, error) {
+	return tag.algo + ":" + text, nil
+}
+
+type OptionalStruct struct {
+	Phone   *string         `gocrypt:"aes"`
+	Missing *string         `gocrypt:"aes"`
+	Email   sql.NullString  `gocrypt:"des"`
+	Null    sql.NullString  `gocrypt:"des"`
+	Backup  *sql.NullString `gocrypt:"rc4"`
+}
+
+func TestInspectFieldOptionalStrings(t *testing.T) {
+	phone := "+62123123123"
+	testData := &OptionalStruct{
+		Phone:  &phone,
+		Email:  sql.NullString{String: "bruce@wayne.com", Valid: true},
+		Null:   sql.NullString{String: "stale"},
+		Backup: &sql.NullString{String: "alfred@wayne.com", Valid: true},
+	}
+
+	if err := newWalker(testEncDec).read(testData); err != nil {
+		t.Fatal(err)
+	}
+	if phone != "aes:+62123123123" {
+		t.Errorf("Phone = %q", phone)
+	}
+	if testData.Missing != nil {
+		t.Errorf("Missing = %v, want nil", testData.Missing)
+	}
+	if testData.Email.String != "des:bruce@wayne.com" || !testData.Email.Valid {
+		t.Errorf("Email = %+v", testData.Email)
+	}
+	if testData.Null.String != "stale" {
+		t.Errorf("Null = %+v, want untouched", testData.Null)
+	}
+	if testData.Backup.String != "rc4:alfred@wayne.com" {
+		t.Errorf("Backup = %+v", testData.Backup)
+	}
+}
+
+type ContainerStruct struct {
+	Emails   []string           `gocrypt:"aes"`
+	Phones   [2]string          `gocrypt:"des"`
+	Attrs    map[string]string  `gocrypt:"rc4"`
+	Optional map[string]*string `gocrypt:"aes"`
+	Labels   map[string]string  `gocrypt:"aes,keys"`
+	Counts   map[string]int     `gocrypt:"des,keys"`
+	Matrix   [][]string         `gocrypt:"aes"`
+	Nullable []sql.NullString   `gocrypt:"aes"`
+	Plain    []string
+}
+
+func TestInspectFieldStringContainers(t *testing.T) {
+	nickname := "batman"
+	testData := &ContainerStruct{
+		Emails:   []string{"a@wayne.com", "b@wayne.com"},
+		Phones:   [2]string{"+621", "+622"},
+		Attrs:    map[string]string{"city": "gotham"},
+		Optional: map[string]*string{"nick": &nickname, "none": nil},
+		Labels:   map[string]string{"team": "justice"},
+		Counts:   map[string]int{"cases": 3},
+		Matrix:   [][]string{{"x"}, {"y", "z"}},
+		Nullable: []sql.NullString{{String: "n", Valid: true}, {}},
+		Plain:    []string{"plain"},
+	}
+
+	if err := newWalker(testEncDec).read(testData); err != nil {
+		t.Fatal(err)
+	}
+
+	want := &ContainerStruct{
+		Emails:   []string{"aes:a@wayne.com", "aes:b@wayne.com"},
+		Phones:   [2]string{"des:+621", "des:+622"},
+		Attrs:    map[string]string{"city": "rc4:gotham"},
+		Optional: map[string]*string{"nick": &nickname, "none": nil},
+		Labels:   map[string]string{"aes:team": "aes:justice"},
+		Counts:   map[string]int{"des:cases": 3},
+		Matrix:   [][]string{{"aes:x"}, {"aes:y", "aes:z"}},
+		Nullable: []sql.NullString{{String: "aes:n", Valid: true}, {}},
+		Plain:    []string{"plain"},
+	}
+	if !reflect.DeepEqual(testData, want) {
+		t.Errorf("got %+v\nwant %+v", testData, want)
+	}
+	if nickname != "aes:batman" {
+		t.Errorf("nickname = %q", nickname)
+	}
+}
+
+type Contact struct {
+	Email string `gocrypt:"aes"`
+}
+
+type AggregateStruct struct {
+	Contacts  []Contact
+	Pointers  []*Contact
+	Fixed     [2]Contact
+	ByName    map[string]Contact
+	ByPointer map[string]*Contact
+	Groups    map[string][]Contact
+	Nested    [][]*Contact
+}
+
+func TestInspectFieldStructContainers(t *testing.T) {
+	testData := &AggregateStruct{
+		Contacts:  []Contact{{Email: "a"}},
+		Pointers:  []*Contact{{Email: "b"}, nil},
+		Fixed:     [2]Contact{{Email: "c"}, {Email: "d"}},
+		ByName:    map[string]Contact{"e": {Email: "e"}},
+		ByPointer: map[string]*Contact{"f": {Email: "f"}, "nil": nil},
+		Groups:    map[string][]Contact{"g": {{Email: "g"}}},
+		Nested:    [][]*Contact{{{Email: "h"}}},
+	}
+
+	if err := newWalker(testEncDec).read(testData); err != nil {
+		t.Fatal(err)
+	}
+
+	want := &AggregateStruct{
+		Contacts:  []Contact{{Email: "aes:a"}},
+		Pointers:  []*Contact{{Email: "aes:b"}, nil},
+		Fixed:     [2]Contact{{Email: "aes:c"}, {Email: "aes:d"}},
+		ByName:    map[string]Contact{"e": {Email: "aes:e"}},
+		ByPointer: map[string]*Contact{"f": {Email: "aes:f"}, "nil": nil},
+		Groups:    map[string][]Contact{"g": {{Email: "aes:g"}}},
+		Nested:    [][]*Contact{{{Email: "aes:h"}}},
+	}
+	if !reflect.DeepEqual(testData, want) {
+		t.Errorf("got %+v\nwant %+v", testData, want)
+	}
+}
+
+func TestReadSlice(t *testing.T) {
+	contacts := []*Contact{{Email: "a"}, {Email: "b"}}
+	if err := newWalker(testEncDec).read(contacts); err != nil {
+		t.Fatal(err)
+	}
+	if contacts[0].Email != "aes:a" || contacts[1].Email != "aes:b" {
+		t.Errorf("got %+v %+v", contacts[0], contacts[1])
+	}
+}
+
+type Node struct {
+	Name     string `gocrypt:"aes"`
+	Parent   *Node
+	Children []*Node
+}
+
+func TestInspectFieldCycles(t *testing.T) {
+	root := &Node{Name: "root"}
+	child := &Node{Name: "child", Parent: root}
+	root.Children = []*Node{child, child}
+	root.Parent = root
+
+	if err := newWalker(testEncDec).read(root); err != nil {
+		t.Fatal(err)
+	}
+	if root.Name != "aes:root" || child.Name != "aes:child" {
+		t.Errorf("root = %q, child = %q, want each transformed once", root.Name, child.Name)
+	}
+}
+
+func TestInspectFieldSharedPointers(t *testing.T) {
+	shared := &Contact{Email: "shared"}
+	phone := "+62"
+	testData := &struct {
+		A, B   *Contact
+		Phones []*string `gocrypt:"des"`
+	}{A: shared, B: shared, Phones: []*string{&phone, &phone}}
+
+	if err := newWalker(testEncDec).read(testData); err != nil {
+		t.Fatal(err)
+	}
+	if shared.Email != "aes:shared" || phone != "des:+62" {
+		t.Errorf("Email = %q, phone = %q, want each transformed once", shared.Email, phone)
+	}
+}
+
+func TestInspectFieldSharedContainers(t *testing.T) {
+	attrs := map[string]string{"a": "x"}
+	labels := map[string]string{"k": "v"}
+	emails := []string{"y"}
+	contacts := map[string]Contact{"c": {Email: "z"}}
+	testData := []ContainerStruct{
+		{Attrs: attrs, Labels: labels, Emails: emails},
+		{Attrs: attrs, Labels: labels, Emails: emails},
+	}
+	aggregates := []struct{ Contacts map[string]Contact }{{contacts}, {contacts}}
+
+	if err := newWalker(testEncDec).read(testData); err != nil {
+		t.Fatal(err)
+	}
+	if err := newWalker(testEncDec).read(aggregates); err != nil {
+		t.Fatal(err)
+	}
+	if attrs["a"] != "rc4:x" || labels["aes:k"] != "aes:v" || len(labels) != 1 || emails[0] != "aes:y" ||
+		contacts["c"].Email != "aes:z" {
+		t.Errorf("attrs = %v, labels = %v, emails = %v, contacts = %v, want each transformed once",
+			attrs, labels, emails, contacts)
+	}
+}
+
+func TestInspectFieldMaxDepth(t *testing.T) {
+	list := &Node{Name: "1"}
+	for i, tail := 2, list; i <= 5; i++ {
+		tail.Children = []*Node{{Name: strconv.Itoa(i)}}
+		tail = tail.Children[0]
+	}
+
+	w := newWalker(testEncDec)
+	w.maxDepth = 3
+	err := w.read(list)
+	if err == nil || !strings.Contains(err.Error(), "max depth 3 exceeded at Children[0].Children[0].Children[0] (gocrypt.Node)") {
+		t.Fatalf("err = %v, want max depth error", err)
+	}
+
+	w = newWalker(testEncDec)
+	w.maxDepth = 5
+	if err := w.read(&Node{Name: "1", Children: []*Node{{Name: "2"}}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type Order struct {
+	Items    []Contact
+	Contacts map[string]*Contact
+	Notes    map[string]string `gocrypt:"des"`
+}
+
+func TestInspectFieldErrorPath(t *testing.T) {
+	cause := errors.New("boom")
+	failOn := func(bad string) changesValue {
+		return func(tag tagOptions, text string) (string, error) {
+			if text == bad {
+				return "", cause
+			}
+			return text, nil
+		}
+	}
+	testData := &Order{
+		Items:    []Contact{{Email: "a"}, {Email: "b"}},
+		Contacts: map[string]*Contact{"home": {Email: "c"}},
+		Notes:    map[string]string{"gift": "d"},
+	}
+
+	tests := []struct {
+		bad  string
+		path string
+		tag  string
+	}{
+		{bad: "b", path: "Items[1].Email", tag: "aes"},
+		{bad: "c", path: "Contacts[home].Email", tag: "aes"},
+		{bad: "d", path: "Notes[gift]", tag: "des"},
+	}
+	for _, tt := range tests {
+		err := newWalker(failOn(tt.bad)).read(testData)
+		var fieldErr *FieldError
+		if !errors.As(err, &fieldErr) {
+			t.Fatalf("err = %v, want *FieldError", err)
+		}
+		if fieldErr.Path != tt.path || fieldErr.Tag != tt.tag || !errors.Is(err, cause) {
+			t.Errorf("err = %+v, want path %s tag %s", fieldErr, tt.path, tt.tag)
+		}
+	}
+}
+
+func TestParseTag(t *testing.T) {
+	tests := []struct {
+		tag  string
+		want tagOptions
+		err  string
+	}{
+		{tag: "aes", want: tagOptions{algo: "aes"}},
+		{tag: "", want: tagOptions{}},
+		{tag: "-", want: tagOptions{skip: true}},
+		{
+			tag:  "aes, omitempty,enc=base64,keyid=pii-2024,keys",
+			want: tagOptions{algo: "aes", omitEmpty: true, encoding: "base64", keyID: "pii-2024", keys: true},
+		},
+		{tag: "aes,enc=base65", want: tagOptions{algo: "aes"}, err: `unknown tag option "enc=base65"`},
+		{tag: "des,omitempty,keyid=", want: tagOptions{algo: "des", omitEmpty: true}, err: `unknown tag option "keyid="`},
+	}
+	for _, tt := range tests {
+		got, err := parseTag(tt.tag)
+		if got != tt.want {
+			t.Errorf("parseTag(%q) = %+v, want %+v", tt.tag, got, tt.want)
+		}
+		if (err == nil && tt.err != "") || (err != nil && err.Error() != tt.err) {
+			t.Errorf("parseTag(%q) error = %v, want %q", tt.tag, err, tt.err)
+		}
+	}
+}
+
+// vendorAddress stands for a type we can't annotate
+type vendorAddress struct {
+	Street  string
+	City    *string
+	Lines   []string
+	Geo     vendorGeo
+	ZipCode int
+	country string
+}
+
+type vendorGeo struct {
+	Label string
+}
+
+type DiveStruct struct {
+	Home   vendorAddress    `gocrypt:"aes,dive"`
+	Others []*vendorAddress `gocrypt:"des,dive"`
+	Plain  vendorAddress
+	Own    ownTagAddress `gocrypt:"aes,dive"`
+}
+
+type ownTagAddress struct {
+	Street string `gocrypt:"rc4"`
+	Public string `gocrypt:"-"`
+	Note   string
+}
+
+func TestInspectFieldDive(t *testing.T) {
+	city := "gotham"
+	testData := &DiveStruct{
+		Home:   vendorAddress{Street: "1007 Mountain Dr", City: &city, Lines: []string{"manor"}, Geo: vendorGeo{Label: "cave"}, ZipCode: 10007, country: "us"},
+		Others: []*vendorAddress{{Street: "Wayne Tower"}},
+		Plain:  vendorAddress{Street: "Crime Alley"},
+		Own:    ownTagAddress{Street: "Park Row", Public: "open", Note: "secret"},
+	}
+
+	if err := newWalker(testEncDec).read(testData); err != nil {
+		t.Fatal(err)
+	}
+
+	want := &DiveStruct{
+		Home:   vendorAddress{Street: "aes:1007 Mountain Dr", City: &city, Lines: []string{"aes:manor"}, Geo: vendorGeo{Label: "aes:cave"}, ZipCode: 10007, country: "us"},
+		Others: []*vendorAddress{{Street: "des:Wayne Tower", Geo: vendorGeo{Label: "des:"}}},
+		Plain:  vendorAddress{Street: "Crime Alley"},
+		Own:    ownTagAddress{Street: "rc4:Park Row", Public: "open", Note: "aes:secret"},
+	}
+	if !reflect.DeepEqual(testData, want) {
+		t.Errorf("got %+v, want %+v", testData, want)
+	}
+	if city != "aes:gotham" {
+		t.Errorf("City = %q", city)
+	}
+}
+
+type Envelope struct {
+	Payload  interface{}
+	Pointer  interface{}
+	Double   interface{}
+	Items    []interface{}
+	ByKey    map[string]interface{}
+	Nothing  interface{}
+	internal interface{}
+}
+
+func TestInspectFieldInterfaces(t *testing.T) {
+	pointer := &Contact{Email: "ptr@wayne.com"}
+	double := &Contact{Email: "double@wayne.com"}
+	hidden := &Contact{Email: "hidden@wayne.com"}
+	testData := &Envelope{
+		Payload:  Contact{Email: "value@wayne.com"},
+		Pointer:  pointer,
+		Double:   &double,
+		Items:    []interface{}{Contact{Email: "a@wayne.com"}, &Contact{Email: "b@wayne.com"}, "plain"},
+		ByKey:    map[string]interface{}{"home": Contact{Email: "home@wayne.com"}},
+		internal: hidden,
+	}
+
+	if err := newWalker(testEncDec).read(testData); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := testData.Payload.(Contact).Email; got != "aes:value@wayne.com" {
+		t.Errorf("Payload.Email = %q", got)
+	}
+	if pointer.Email != "aes:ptr@wayne.com" || double.Email != "aes:double@wayne.com" {
+		t.Errorf("Pointer.Email = %q, Double.Email = %q", pointer.Email, double.Email)
+	}
+	if got := testData.Items[0].(Contact).Email; got != "aes:a@wayne.com" {
+		t.Errorf("Items[0].Email = %q", got)
+	}
+	if got := testData.Items[1].(*Contact).Email; got != "aes:b@wayne.com" {
+		t.Errorf("Items[1].Email = %q", got)
+	}
+	if testData.Items[2] != "plain" {
+		t.Errorf("Items[2] = %v, want untouched", testData.Items[2])
+	}
+	if got := testData.ByKey["home"].(Contact).Email; got != "aes:home@wayne.com" {
+		t.Errorf("ByKey[home].Email = %q", got)
+	}
+	if hidden.Email != "hidden@wayne.com" {
+		t.Errorf("internal.Email = %q, want untouched", hidden.Email)
+	}
+}
+
+type EmbeddedBase struct {
+	Email string `gocrypt:"aes"`
+}
+
+type embeddedAudit struct {
+	Actor string `gocrypt:"des"`
+}
+
+type Payload interface{}
+
+type EmbeddedStruct struct {
+	EmbeddedBase
+	*Contact
+	embeddedAudit
+	Payload
+	Name string `gocrypt:"rc4"`
+}
+
+func TestInspectFieldEmbedded(t *testing.T) {
+	testData := &EmbeddedStruct{
+		EmbeddedBase:  EmbeddedBase{Email: "base@wayne.com"},
+		Contact:       &Contact{Email: "contact@wayne.com"},
+		embeddedAudit: embeddedAudit{Actor: "alfred"},
+		Payload:       EmbeddedBase{Email: "payload@wayne.com"},
+		Name:          "bruce",
+	}
+
+	if err := newWalker(testEncDec).read(testData); err != nil {
+		t.Fatal(err)
+	}
+
+	want := &EmbeddedStruct{
+		EmbeddedBase:  EmbeddedBase{Email: "aes:base@wayne.com"},
+		Contact:       &Contact{Email: "aes:contact@wayne.com"},
+		embeddedAudit: embeddedAudit{Actor: "des:alfred"},
+		Payload:       EmbeddedBase{Email: "aes:payload@wayne.com"},
+		Name:          "rc4:bruce",
+	}
+	if !reflect.DeepEqual(testData, want) {
+		t.Errorf("got %+v, want %+v", testData, want)
+	}
+
+	// a nil embedded pointer is skipped
+	if err := newWalker(testEncDec).read(&EmbeddedStruct{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type MaskStruct struct {
+	Name     string   `mask:"partial"`
+	Emails   []string `mask:"full,omitempty"`
+	Contacts map[string]*Contact
+	Secret   string `gocrypt:"aes"`
+}
+
+func TestWalk(t *testing.T) {
+	testData := &MaskStruct{
+		Name:     "bruce",
+		Emails:   []string{"a@wayne.com", ""},
+		Contacts: map[string]*Contact{"home": {Email: "home@wayne.com"}},
+		Secret:   "cave",
+	}
+
+	var paths []string
+	err := Walk(testData, "mask", func(path FieldPath, tag TagOptions, value string) (string, error) {
+		paths = append(paths, path.String()+"="+tag.Algorithm)
+		if tag.Algorithm == "partial" {
+			return value[:1] + "****", nil
+		}
+		return "****", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &MaskStruct{
+		Name:     "b****",
+		Emails:   []string{"****", ""},
+		Contacts: testData.Contacts,
+		Secret:   "cave",
+	}
+	if !reflect.DeepEqual(testData, want) {
+		t.Errorf("got %+v, want %+v", testData, want)
+	}
+	if testData.Contacts["home"].Email != "home@wayne.com" {
+		t.Errorf("Contacts[home].Email = %q, want untouched by the mask tag", testData.Contacts["home"].Email)
+	}
+	if got := strings.Join(paths, " "); got != "Name=partial Emails[0]=full" {
+		t.Errorf("paths = %q", got)
+	}
+
+	// the default tag name is gocrypt, and errors carry the path
+	err = Walk(testData, "", func(path FieldPath, tag TagOptions, value string) (string, error) {
+		return "", errors.New("boom")
+	})
+	var fieldErr *FieldError
+	if !errors.As(err, &fieldErr) || fieldErr.Path != "Secret" || fieldErr.Tag != "aes" {
+		t.Errorf("err = %v, want FieldError at Secret", err)
 	}
 }
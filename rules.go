@@ -0,0 +1,258 @@
+package gocrypt
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Rules maps a field path to a tag, for types that can't carry struct tags,
+// e.g. Rules{"Email": "aes", "Address.Street": "aes256gcm,omitempty"}. A
+// dotted path names a field of a nested struct, the rule then applies to that
+// field only beneath the path, other uses of the nested type keep their tags.
+// A rule replaces the struct tag of its field, "-" excludes the field.
+type Rules map[string]string
+
+// registry holds the rules of an Option by struct type. It is never modified
+// once built, Register builds a new one, so it can be part of the type cache
+// key. Type information derived from rules is cached in the registry rather
+// than the package cache, and is dropped along with it.
+type registry struct {
+	types  map[reflect.Type]*ruleNode
+	merged sync.Map // map[[2]*ruleNode]*ruleNode, see scope
+	cache  sync.Map // map[typeKey]*typeInfo
+}
+
+// ruleNode holds the rules of a struct by field name, and the rules of the
+// structs beneath its fields, which come from dotted paths.
+type ruleNode struct {
+	fields map[string]string
+	nested map[string]*ruleNode
+}
+
+// lookup returns the rule of a field of typ. scope holds the rules of the
+// path typ was reached by, they take precedence over the rules of typ.
+func (r *registry) lookup(typ reflect.Type, scope *ruleNode, field string) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	if rule, ok := scope.rule(field); ok {
+		return rule, true
+	}
+	return r.types[typ].rule(field)
+}
+
+// scope returns the rules of the path through a field of typ, or nil if no
+// rule reaches beneath it. The result is part of type cache keys, so the
+// merge of two scopes is built once.
+func (r *registry) scope(typ reflect.Type, scope *ruleNode, field string) *ruleNode {
+	if r == nil {
+		return nil
+	}
+	outer := scope.child(field)
+	inner := r.types[typ].child(field)
+	switch {
+	case outer == nil:
+		return inner
+	case inner == nil:
+		return outer
+	}
+	key := [2]*ruleNode{outer, inner}
+	if merged, ok := r.merged.Load(key); ok {
+		return merged.(*ruleNode)
+	}
+	merged, _ := r.merged.LoadOrStore(key, mergeRules(outer, inner))
+	return merged.(*ruleNode)
+}
+
+func (n *ruleNode) rule(field string) (string, bool) {
+	if n == nil {
+		return "", false
+	}
+	rule, ok := n.fields[field]
+	return rule, ok
+}
+
+func (n *ruleNode) child(field string) *ruleNode {
+	if n == nil {
+		return nil
+	}
+	return n.nested[field]
+}
+
+// set adds the rule of a field path
+func (n *ruleNode) set(path []string, rule string) {
+	for _, name := range path[:len(path)-1] {
+		if n.nested == nil {
+			n.nested = make(map[string]*ruleNode)
+		}
+		if n.nested[name] == nil {
+			n.nested[name] = &ruleNode{}
+		}
+		n = n.nested[name]
+	}
+	if n.fields == nil {
+		n.fields = make(map[string]string)
+	}
+	n.fields[path[len(path)-1]] = rule
+}
+
+func (n *ruleNode) copy() *ruleNode {
+	dup := &ruleNode{fields: copyFields(n.fields)}
+	if n.nested != nil {
+		dup.nested = make(map[string]*ruleNode, len(n.nested))
+		for name, nested := range n.nested {
+			dup.nested[name] = nested.copy()
+		}
+	}
+	return dup
+}
+
+// mergeRules returns the rules of outer and inner, outer wins
+func mergeRules(outer, inner *ruleNode) *ruleNode {
+	merged := inner.copy()
+	for name, rule := range outer.fields {
+		merged.set([]string{name}, rule)
+	}
+	for name, nested := range outer.nested {
+		if merged.nested == nil {
+			merged.nested = make(map[string]*ruleNode)
+		}
+		if merged.nested[name] == nil {
+			merged.nested[name] = nested.copy()
+		} else {
+			merged.nested[name] = mergeRules(nested, merged.nested[name])
+		}
+	}
+	return merged
+}
+
+// Register adds rules for the struct type typ, or the struct type it points
+// to. Later rules for the same field replace earlier ones. Register is meant
+// for setup and must not run concurrently with other methods of opt.
+func (opt *Option) Register(typ reflect.Type, rules Rules) error {
+	return opt.RegisterRules(map[reflect.Type]Rules{typ: rules})
+}
+
+// RegisterRules adds the rules of several types at once, either all of them
+// or, on error, none.
+func (opt *Option) RegisterRules(rules map[reflect.Type]Rules) error {
+	next := &registry{types: make(map[reflect.Type]*ruleNode)}
+	if opt.rules != nil {
+		for typ, node := range opt.rules.types {
+			next.types[typ] = node.copy()
+		}
+	}
+
+	for typ, typeRules := range rules {
+		if typ != nil && typ.Kind() == reflect.Ptr {
+			typ = typ.Elem()
+		}
+		if typ == nil || typ.Kind() != reflect.Struct {
+			return newError(ErrUnsupportedType, "rules need a struct type, got "+typeString(typ))
+		}
+		for path, rule := range typeRules {
+			if _, err := parseTag(rule); err != nil {
+				return wrapError(ErrInvalidTag, err, typ.String()+"."+path)
+			}
+			if err := checkRulePath(typ, path); err != nil {
+				return err
+			}
+			if next.types[typ] == nil {
+				next.types[typ] = &ruleNode{}
+			}
+			next.types[typ].set(strings.Split(path, "."), rule)
+		}
+	}
+
+	opt.rules = next
+	return nil
+}
+
+// LoadRules reads rules from a JSON document keyed by qualified type name,
+// e.g. {"github.com/acme/vendor.User": {"Email": "aes"}}. types are the types
+// the document may name, every name must match one of them. A YAML document
+// can be decoded into map[string]Rules and passed to RegisterNamedRules.
+func (opt *Option) LoadRules(r io.Reader, types ...reflect.Type) error {
+	var named map[string]Rules
+	if err := json.NewDecoder(r).Decode(&named); err != nil {
+		return wrapError(ErrInvalidTag, err, "LoadRules")
+	}
+	return opt.RegisterNamedRules(named, types...)
+}
+
+// RegisterNamedRules adds rules keyed by qualified type name, see LoadRules.
+func (opt *Option) RegisterNamedRules(named map[string]Rules, types ...reflect.Type) error {
+	byName := make(map[string]reflect.Type, len(types))
+	for _, typ := range types {
+		if typ != nil && typ.Kind() == reflect.Ptr {
+			typ = typ.Elem()
+		}
+		if typ != nil {
+			byName[qualifiedName(typ)] = typ
+		}
+	}
+
+	rules := make(map[reflect.Type]Rules, len(named))
+	for name, typeRules := range named {
+		typ, ok := byName[name]
+		if !ok {
+			return newError(ErrUnsupportedType, "rules for unknown type "+strconv.Quote(name))
+		}
+		rules[typ] = typeRules
+	}
+	return opt.RegisterRules(rules)
+}
+
+// checkRulePath follows a dotted rule path from typ and checks that every
+// name on it is an exported field, and all but the last one hold structs.
+func checkRulePath(typ reflect.Type, path string) error {
+	names := strings.Split(path, ".")
+	for i, name := range names {
+		field, ok := typ.FieldByName(name)
+		switch {
+		case !ok || len(field.Index) != 1:
+			return newError(ErrInvalidTag, typ.String()+" has no field "+strconv.Quote(name)+" in rule "+strconv.Quote(path))
+		case field.PkgPath != "":
+			return newError(ErrInvalidTag, typ.String()+"."+name+" is unexported in rule "+strconv.Quote(path))
+		case i == len(names)-1:
+			return nil
+		}
+
+		typ = field.Type
+		for typ.Kind() == reflect.Ptr || typ.Kind() == reflect.Slice || typ.Kind() == reflect.Array || typ.Kind() == reflect.Map {
+			typ = typ.Elem()
+		}
+		if typ.Kind() != reflect.Struct {
+			return newError(ErrInvalidTag, field.Name+" is not a struct in rule "+strconv.Quote(path))
+		}
+	}
+	return newError(ErrInvalidTag, "empty rule path")
+}
+
+func copyFields(fields map[string]string) map[string]string {
+	dup := make(map[string]string, len(fields))
+	for name, rule := range fields {
+		dup[name] = rule
+	}
+	return dup
+}
+
+// qualifiedName returns the import path and name of a named type, e.g.
+// github.com/acme/vendor.User
+func qualifiedName(typ reflect.Type) string {
+	if typ.PkgPath() == "" {
+		return typ.String()
+	}
+	return typ.PkgPath() + "." + typ.Name()
+}
+
+func typeString(typ reflect.Type) string {
+	if typ == nil {
+		return "nil"
+	}
+	return typ.String()
+}
@@ -0,0 +1,195 @@
+package gocrypt
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// CallOption changes a single Encrypt or Decrypt call
+type CallOption func(*callOptions)
+
+type callOptions struct {
+	only    []string
+	hasOnly bool // Only was passed, even without paths
+	except  []string
+	workers int
+}
+
+// Only restricts a call to the given field paths and everything beneath
+// them, e.g. Only("Profile.PhoneNumber", "Identity"). A path is made of field
+// names, slices, arrays and maps along the way are crossed without an index,
+// so "Items.Email" selects the email of every item. Only without paths
+// selects nothing.
+func Only(paths ...string) CallOption {
+	return func(o *callOptions) {
+		o.only = append(o.only, paths...)
+		o.hasOnly = true
+	}
+}
+
+// Except leaves the given field paths and everything beneath them alone, see
+// Only. Except wins over Only.
+func Except(paths ...string) CallOption {
+	return func(o *callOptions) {
+		o.except = append(o.except, paths...)
+	}
+}
+
+// Workers spreads the elements of a slice or array passed to a call across
+// n goroutines. Elements may share pointers, maps and slices, a shared value
+// is transformed once, by the goroutine reaching it first. Errors are reported
+// as without Workers: the error of the lowest index, or in ContinueOnError
+// mode all of them in index order. OnError may be called concurrently, and
+// the options must be safe for concurrent use, which the built-in options
+// are.
+func Workers(n int) CallOption {
+	return func(o *callOptions) {
+		o.workers = n
+	}
+}
+
+// selection is a tree of selected field paths. A node with all set selects
+// its whole subtree.
+type selection struct {
+	all    bool
+	fields map[string]*selection
+}
+
+func (s *selection) add(names []string) {
+	for _, name := range names {
+		if s.all {
+			return
+		}
+		if s.fields == nil {
+			s.fields = make(map[string]*selection)
+		}
+		child, ok := s.fields[name]
+		if !ok {
+			child = &selection{}
+			s.fields[name] = child
+		}
+		s = child
+	}
+	s.all, s.fields = true, nil
+}
+
+// fieldSelection is the position of the walker in the Only and Except trees,
+// a nil tree doesn't restrict anything.
+type fieldSelection struct {
+	only   *selection
+	except *selection
+}
+
+// selectField moves the walker into the field name. It returns the previous
+// position, to restore once the field is done, and whether the field is
+// selected at all.
+func (w *walker) selectField(name string) (fieldSelection, bool) {
+	prev := w.selection
+	if prev.only == nil && prev.except == nil {
+		return prev, true
+	}
+
+	next := prev
+	if prev.only != nil && !prev.only.all {
+		next.only = prev.only.fields[name]
+		if next.only == nil {
+			return prev, false
+		}
+	}
+	if prev.except != nil {
+		next.except = prev.except.fields[name]
+		if next.except != nil && next.except.all {
+			return prev, false
+		}
+	}
+	w.selection = next
+	return prev, true
+}
+
+// applyCallOptions sets up the call options of a call on v, and checks every
+// path against the type of v.
+func (w *walker) applyCallOptions(v interface{}, opts []CallOption) error {
+	if len(opts) == 0 {
+		return nil
+	}
+	var o callOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	w.workers = o.workers
+
+	typ := reflect.TypeOf(v)
+	// a nil tree selects everything, an empty one nothing
+	build := func(paths []string, passed bool) (*selection, error) {
+		if !passed {
+			return nil, nil
+		}
+		root := &selection{}
+		for _, path := range paths {
+			names := strings.Split(path, ".")
+			if err := w.checkFieldPath(typ, names); err != nil {
+				return nil, wrapError(ErrUnknownField, err, "field path "+strconv.Quote(path))
+			}
+			root.add(names)
+		}
+		return root, nil
+	}
+
+	var err error
+	if w.selection.only, err = build(o.only, o.hasOnly); err != nil {
+		return err
+	}
+	w.selection.except, err = build(o.except, len(o.except) > 0)
+	return err
+}
+
+// checkFieldPath checks that names lead to a field gocrypt transforms, or to
+// a struct holding some, using the cached type information. Paths going
+// through an interface can only be checked up to it.
+func (w *walker) checkFieldPath(typ reflect.Type, names []string) error {
+	var (
+		inherit tagOptions
+		scope   *ruleNode
+	)
+	for i, name := range names {
+		for typ != nil && (typ.Kind() == reflect.Ptr || typ.Kind() == reflect.Slice ||
+			typ.Kind() == reflect.Array || typ.Kind() == reflect.Map) {
+			typ = typ.Elem()
+		}
+		switch {
+		case typ == nil || typ.Kind() == reflect.Interface:
+			return nil
+		case typ.Kind() != reflect.Struct && i == 0:
+			return newError(ErrUnknownField, typ.String()+" is not a struct")
+		case typ.Kind() != reflect.Struct:
+			return newError(ErrUnknownField, names[i-1]+" is not a struct")
+		}
+
+		info := getTypeInfo(w.typeKey(typ, inherit, scope))
+		last := i == len(names)-1
+		if last && (hasField(info.stringFields, name) || hasField(info.intoFields, name)) {
+			return nil
+		}
+		next, ok := findField(info.structFields, name)
+		if !ok {
+			return newError(ErrUnknownField, typ.String()+" has no field "+name+" to transform")
+		}
+		typ, inherit, scope = next.fieldType, next.tag, next.scope
+	}
+	return nil
+}
+
+func hasField(fields []fieldInfo, name string) bool {
+	_, ok := findField(fields, name)
+	return ok
+}
+
+func findField(fields []fieldInfo, name string) (fieldInfo, bool) {
+	for _, field := range fields {
+		if field.name == name {
+			return field, true
+		}
+	}
+	return fieldInfo{}, false
+}
@@ -0,0 +1,58 @@
+package gocrypt
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// tagOptions is a parsed gocrypt tag: the algorithm followed by comma
+// separated modifiers, e.g. `gocrypt:"aes,omitempty,enc=base64,keyid=pii-2024"`.
+type tagOptions struct {
+	algo      string
+	skip      bool   // "-", the field is explicitly excluded and not walked
+	omitEmpty bool   // "omitempty", empty strings are left alone
+	keys      bool   // "keys", map keys are transformed as well as values
+	encoding  string // "enc=hex|base64|base64url", the ciphertext encoding
+	keyID     string // "keyid=ID", use the named key Option.Keys[ID]
+	into      string // "into=FIELD", encrypt a non-string value into the string field FIELD
+	dive      bool   // "dive", untagged string leaves beneath a struct field inherit the tag
+}
+
+// parseTag parses a gocrypt tag. It returns the options it could parse along
+// with the first problem found, which is only reported in strict mode.
+func parseTag(tag string) (tagOptions, error) {
+	parts := strings.Split(tag, ",")
+	opts := tagOptions{algo: strings.TrimSpace(parts[0])}
+	if opts.algo == "-" && len(parts) == 1 {
+		return tagOptions{skip: true}, nil
+	}
+
+	var err error
+	for _, mod := range parts[1:] {
+		mod = strings.TrimSpace(mod)
+		name, value := mod, ""
+		if i := strings.IndexByte(mod, '='); i >= 0 {
+			name, value = mod[:i], mod[i+1:]
+		}
+
+		switch {
+		case mod == "omitempty":
+			opts.omitEmpty = true
+		case mod == "keys":
+			opts.keys = true
+		case mod == "dive":
+			opts.dive = true
+		case name == "enc" && isEncoding(value):
+			opts.encoding = value
+		case name == "keyid" && value != "":
+			opts.keyID = value
+		case name == "into" && value != "":
+			opts.into = value
+		case err == nil:
+			err = errors.New("unknown tag option " + strconv.Quote(mod))
+		}
+	}
+	return opts, err
+}
@@ -1,12 +1,8 @@
 package gocrypt
 
 import (
-	"bytes"
 	"crypto/cipher"
 	"crypto/des"
-	"crypto/rand"
-	"encoding/base64"
-	"io"
 
 	"github.com/pkg/errors"
 )
@@ -38,62 +34,104 @@ func NewDESOpt(secret string) (*DESOpt, error) {
 
 // Encrypt is function to encrypt data using DES algorithm
 func (desOpt *DESOpt) Encrypt(plainText []byte) (string, error) {
-	if desOpt == nil || desOpt.block == nil {
-		return "", errors.New("DESOpt is not properly initialized")
+	return sealBytes(desOpt, encodingBase64URL, plainText)
+}
+
+// EncryptRaw is function to encrypt data using DES algorithm without
+// encoding the result, the IV is prefixed to the ciphertext
+func (desOpt *DESOpt) EncryptRaw(plainText []byte) ([]byte, error) {
+	dst := make([]byte, desOpt.sealedLen(len(plainText)))
+	copy(dst[des.BlockSize:], plainText)
+	if err := desOpt.seal(dst, len(plainText)); err != nil {
+		return nil, err
 	}
-	block := desOpt.block
-	blockSize := desOpt.blockSize
+	return dst, nil
+}
 
-	// Generate a random IV for each encryption
-	iv := make([]byte, blockSize)
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return "", errors.Wrap(err, "Encrypt.io.ReadFull")
+// Decrypt is function to decypt data using DES algorithm
+func (desOpt *DESOpt) Decrypt(cipherText []byte) (string, error) {
+	if desOpt == nil || desOpt.block == nil {
+		return "", newError(ErrNotInitialized, "DESOpt is not properly initialized")
 	}
+	return openBytes(desOpt, encodingBase64URL, cipherText)
+}
+
+// DecryptRaw is function to decrypt data produced by EncryptRaw using DES algorithm
+func (desOpt *DESOpt) DecryptRaw(rbyte []byte) ([]byte, error) {
+	return desOpt.open(append([]byte(nil), rbyte...))
+}
 
-	origData := pkcs5Padding(plainText, blockSize)
-	mode := cipher.NewCBCEncrypter(block, iv)
-	encrypted := make([]byte, len(origData))
-	mode.CryptBlocks(encrypted, origData)
+func (desOpt *DESOpt) prefixLen() int       { return des.BlockSize }
+func (desOpt *DESOpt) textEncoding() string { return encodingBase64URL }
 
-	// Prepend IV to ciphertext (like AES does with nonce)
-	ciphertext := append(iv, encrypted...)
-	return base64.URLEncoding.EncodeToString(ciphertext), nil
+// sealedLen is the IV followed by the plain text padded to whole blocks
+func (desOpt *DESOpt) sealedLen(n int) int {
+	return des.BlockSize + (n/des.BlockSize+1)*des.BlockSize
 }
 
-// Decrypt is function to decypt data using DES algorithm
-func (desOpt *DESOpt) Decrypt(cipherText []byte) (string, error) {
+// seal encrypts in CBC mode in place, with a random IV for each encryption
+// prepended to the ciphertext (like AES does with nonce)
+func (desOpt *DESOpt) seal(dst []byte, n int) error {
 	if desOpt == nil || desOpt.block == nil {
-		return "", errors.New("DESOpt is not properly initialized")
+		return newError(ErrNotInitialized, "DESOpt is not properly initialized")
 	}
-	block := desOpt.block
 	blockSize := desOpt.blockSize
 
-	rbyte, err := base64.URLEncoding.DecodeString(string(cipherText))
-	if err != nil {
-		return "", errors.Wrap(err, "Decrypt.base64.URLEncoding.DecodeString")
+	if err := nonces.read(dst[:blockSize]); err != nil {
+		return err
 	}
+	pkcs5Padding(dst[blockSize:], n, blockSize)
+
+	for i := blockSize; i < len(dst); i += blockSize {
+		block := dst[i : i+blockSize]
+		xorBytes(block, dst[i-blockSize:i])
+		desOpt.block.Encrypt(block, block)
+	}
+	return nil
+}
+
+// open decrypts in CBC mode in place, going from the last block to the first
+// so that each block is still ciphertext when the next one needs it
+func (desOpt *DESOpt) open(rbyte []byte) ([]byte, error) {
+	if desOpt == nil || desOpt.block == nil {
+		return nil, newError(ErrNotInitialized, "DESOpt is not properly initialized")
+	}
+	blockSize := desOpt.blockSize
 
 	// Extract IV from the beginning of the ciphertext
 	if len(rbyte) < blockSize {
-		return "", errors.New("ciphertext too short to contain IV")
+		return nil, newError(ErrMalformedCiphertext, "ciphertext too short to contain IV")
 	}
-	iv := rbyte[:blockSize]
 	ciphertext := rbyte[blockSize:]
+	if len(ciphertext) == 0 || len(ciphertext)%blockSize != 0 {
+		return nil, newError(ErrMalformedCiphertext, "ciphertext is not a multiple of the block size")
+	}
 
-	decrypter := cipher.NewCBCDecrypter(block, iv)
-	decrypted := make([]byte, len(ciphertext))
-	decrypter.CryptBlocks(decrypted, ciphertext)
-	decrypted, err = pkcs5Unpadding(decrypted)
+	for i := len(rbyte) - blockSize; i >= blockSize; i -= blockSize {
+		block := rbyte[i : i+blockSize]
+		desOpt.block.Decrypt(block, block)
+		xorBytes(block, rbyte[i-blockSize:i])
+	}
+	decrypted, err := pkcs5Unpadding(ciphertext)
 	if err != nil {
-		return "", errors.Wrap(err, "Decrypt.pkcs5Unpadding")
+		return nil, wrapError(ErrAuthenticationFailed, err, "Decrypt.pkcs5Unpadding")
+	}
+	return decrypted, nil
+}
+
+func xorBytes(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
 	}
-	return string(decrypted), nil
 }
 
-func pkcs5Padding(ciphertext []byte, blockSize int) []byte {
-	padding := blockSize - len(ciphertext)%blockSize
-	padtext := bytes.Repeat([]byte{byte(padding)}, padding)
-	return append(ciphertext, padtext...)
+// pkcs5Padding pads the n bytes of data at the start of dst to the end of
+// dst, which is the padded length
+func pkcs5Padding(dst []byte, n, blockSize int) {
+	padding := byte(blockSize - n%blockSize)
+	for i := n; i < len(dst); i++ {
+		dst[i] = padding
+	}
 }
 
 func pkcs5Unpadding(origData []byte) ([]byte, error) {
@@ -0,0 +1,58 @@
+package gocrypt
+
+// WalkFunc is called by Walk for every tagged string, with the path of the
+// field, its parsed tag and its value. The returned string replaces the
+// value, an error stops the walk.
+type WalkFunc func(path FieldPath, tag TagOptions, value string) (string, error)
+
+// TagOptions is a parsed struct tag, e.g. `mask:"partial,omitempty"`
+type TagOptions struct {
+	Algorithm string // the first element of the tag, e.g. aes or partial
+	OmitEmpty bool   // omitempty
+	Keys      bool   // keys
+	Encoding  string // enc=ENCODING
+	KeyID     string // keyid=ID
+	Into      string // into=FIELD
+	Dive      bool   // dive
+}
+
+// FieldPath is the path of a value from the value passed to Walk. It is only
+// valid during the call to WalkFunc, use String to keep it.
+type FieldPath struct {
+	elems []pathElem
+}
+
+// String renders the path, e.g. Items[3].Email or Contacts[home].Email
+func (p FieldPath) String() string {
+	return renderPath(p.elems)
+}
+
+// Walk calls fn for every string field tagged with tagName in v, and
+// replaces the values with the results. It is the engine of Encrypt and
+// Decrypt, with the same tag grammar, type cache and traversal: pointers,
+// slices, arrays, maps, interfaces, embedded structs and dive fields are
+// followed, and into fields get the text of their value in the companion
+// field. Errors of fn are returned as a *FieldError. v must be a pointer for
+// the changes to be visible. An empty tagName means GOCRYPT.
+func Walk(v interface{}, tagName string, fn WalkFunc) error {
+	w := newWalker(nil)
+	if tagName != "" {
+		w.tagName = tagName
+	}
+	w.encDec = func(tag tagOptions, value string) (string, error) {
+		return fn(FieldPath{elems: w.path}, tag.export(), value)
+	}
+	return w.read(v)
+}
+
+func (t tagOptions) export() TagOptions {
+	return TagOptions{
+		Algorithm: t.algo,
+		OmitEmpty: t.omitEmpty,
+		Keys:      t.keys,
+		Encoding:  t.encoding,
+		KeyID:     t.keyID,
+		Into:      t.into,
+		Dive:      t.dive,
+	}
+}